@@ -5,10 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,13 +24,312 @@ type Server struct {
 	Address                string `yaml:"address" json:"address"`
 	DownloadPath           string `yaml:"download_path" json:"download_path"`
 	MaximumActiveDownloads int    `yaml:"maximum_active_downloads_per_domain" json:"maximum_active_downloads_per_domain"`
+	MaximumActiveTotal     int    `yaml:"maximum_active_downloads_total" json:"maximum_active_downloads_total"` // across all domains, 0 for no limit
+	ShutdownGracePeriod    string `yaml:"shutdown_grace_period" json:"shutdown_grace_period"`                   // how long running downloads get to exit when shutting down, like "30s"
+	QueuePolicy            string `yaml:"queue_policy" json:"queue_policy"`                                     // which queued downloads are started first, one of the QUEUE_POLICY constants
+	StallTimeout           string `yaml:"stall_timeout" json:"stall_timeout"`                                   // how long a download can go without progress before it is killed, like "30m", empty or "0" to never kill
+	StopInterruptWait      string `yaml:"stop_interrupt_wait" json:"stop_interrupt_wait"`                       // when stopping a download, how long to wait after interrupting it before terminating it, like "5s"
+	StopTerminateWait      string `yaml:"stop_terminate_wait" json:"stop_terminate_wait"`                       // when stopping a download, how long to wait after terminating it before killing it, like "5s"
+	MaximumLogLines        int    `yaml:"maximum_log_lines" json:"maximum_log_lines"`                           // how many lines of each download's log are kept in memory, 0 for no limit, the full log is always written to disk
+}
+
+// DefaultMaximumLogLines is used for new and migrated configurations.
+const DefaultMaximumLogLines = 1000
+
+// DefaultStopWait is used for the stop waits when the config does not specify
+// them.
+const DefaultStopWait = "5s"
+
+// InterruptWait returns how long to wait for a download being stopped to exit
+// after interrupting it, before terminating it.
+func (s Server) InterruptWait() time.Duration {
+	d, err := time.ParseDuration(s.StopInterruptWait)
+	if err != nil {
+		d, _ = time.ParseDuration(DefaultStopWait)
+	}
+	return d
+}
+
+// TerminateWait returns how long to wait for a download being stopped to exit
+// after terminating it, before killing it.
+func (s Server) TerminateWait() time.Duration {
+	d, err := time.ParseDuration(s.StopTerminateWait)
+	if err != nil {
+		d, _ = time.ParseDuration(DefaultStopWait)
+	}
+	return d
+}
+
+// DefaultStallTimeout is used for new and migrated configurations.
+const DefaultStallTimeout = "30m"
+
+// StallTimeoutDuration returns how long a download may go without making any
+// progress before it is killed, or 0 if downloads are never killed for it.
+func (s Server) StallTimeoutDuration() time.Duration {
+	if s.StallTimeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s.StallTimeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Queue policies, which determine the order queued downloads are started in
+const (
+	QUEUE_POLICY_PRIORITY    = "priority"    // highest priority first, then in list order
+	QUEUE_POLICY_FIFO        = "fifo"        // in list order, ignoring priority
+	QUEUE_POLICY_ROUND_ROBIN = "round_robin" // take turns between domains, by priority within each domain
+	QUEUE_POLICY_FAIR        = "fair"        // take turns between submission batches, and between domains within each batch
+)
+
+// DefaultShutdownGracePeriod is used when the config does not specify one.
+const DefaultShutdownGracePeriod = "30s"
+
+// ShutdownGrace returns how long to wait for running downloads to exit
+// when shutting down.
+func (s Server) ShutdownGrace() time.Duration {
+	d, err := time.ParseDuration(s.ShutdownGracePeriod)
+	if err != nil {
+		d, _ = time.ParseDuration(DefaultShutdownGracePeriod)
+	}
+	return d
 }
 
 // DownloadProfile holds the details for executing a downloader
 type DownloadProfile struct {
-	Name    string   `yaml:"name" json:"name"`
-	Command string   `yaml:"command" json:"command"`
-	Args    []string `yaml:"args" json:"args"`
+	Name    string      `yaml:"name" json:"name"`
+	Command string      `yaml:"command" json:"command"`
+	Args    []string    `yaml:"args" json:"args"`
+	Retry   RetryPolicy `yaml:"retry" json:"retry"`
+	// how many downloads using this profile can be active at once, 0 for no limit
+	MaximumActiveDownloads int `yaml:"maximum_active_downloads" json:"maximum_active_downloads"`
+	// how long a download using this profile can run before it is killed, like "2h", empty for no limit
+	MaximumRuntime string `yaml:"maximum_runtime" json:"maximum_runtime"`
+	// what to do with the partial files left behind when a download using this profile is stopped or fails, one of the CLEANUP constants
+	Cleanup string `yaml:"cleanup" json:"cleanup"`
+	// restrictions on the resources the downloader can use, only supported on linux
+	Limits ProcessLimits `yaml:"limits" json:"limits"`
+	// have yt-dlp report its progress as JSON, rather than parsing its usual output
+	StructuredProgress bool `yaml:"structured_progress" json:"structured_progress"`
+	// have yt-dlp print the final path of each file, rather than following them in its usual output
+	TrackFiles bool `yaml:"track_files" json:"track_files"`
+	// how the output of the downloader is understood, one of the PARSER constants
+	Parser string `yaml:"parser" json:"parser"`
+	// for the custom parser, regular expressions using the ParserGroups as named groups
+	Patterns []string `yaml:"patterns" json:"patterns"`
+}
+
+// Parsers, which understand the output of different downloaders
+const (
+	PARSER_YT_DLP     = ""           // yt-dlp, or youtube-dl
+	PARSER_GALLERY_DL = "gallery-dl" // gallery-dl
+	PARSER_ARIA2C     = "aria2c"     // aria2c
+	PARSER_WGET       = "wget"       // wget
+	PARSER_CUSTOM     = "custom"     // the patterns in the profile
+)
+
+// ParserGroups are the named groups which the patterns for the custom parser
+// can use, for the details of the download they match.
+var ParserGroups = []string{"percent", "eta", "file", "playlist_current", "playlist_total", "state"}
+
+// validateParser checks the parser, and the patterns for the custom parser,
+// for sanity.
+func (p DownloadProfile) validateParser() error {
+	if p.Parser != PARSER_YT_DLP && (p.StructuredProgress || p.TrackFiles) {
+		return fmt.Errorf("structured progress and file tracking in profile '%s' need the yt-dlp parser", p.Name)
+	}
+	switch p.Parser {
+	case PARSER_YT_DLP, PARSER_GALLERY_DL, PARSER_ARIA2C, PARSER_WGET:
+		return nil
+	case PARSER_CUSTOM:
+	default:
+		return fmt.Errorf("unknown parser '%s' in profile '%s'", p.Parser, p.Name)
+	}
+
+	if len(p.Patterns) == 0 {
+		return fmt.Errorf("the custom parser in profile '%s' needs at least one pattern", p.Name)
+	}
+	for _, pattern := range p.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern '%s' in profile '%s': %s", pattern, p.Name, err)
+		}
+		named := 0
+		for _, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(ParserGroups, name) {
+				return fmt.Errorf("unknown group '%s' in pattern '%s' in profile '%s', should be one of %s", name, pattern, p.Name, strings.Join(ParserGroups, ", "))
+			}
+			named++
+		}
+		if named == 0 {
+			return fmt.Errorf("pattern '%s' in profile '%s' has no named groups", pattern, p.Name)
+		}
+	}
+	return nil
+}
+
+// Cleanup policies, which determine what happens to the partial files left
+// behind by stopped or failed downloads
+const (
+	CLEANUP_NONE      = ""          // leave them alone
+	CLEANUP_CONFIRM   = "confirm"   // list them in the popup, and remove them when asked
+	CLEANUP_AUTOMATIC = "automatic" // remove them as soon as the download is stopped or fails
+)
+
+// MaxRuntime returns how long a download using this profile may run before it
+// is killed, or 0 if there is no limit.
+func (p DownloadProfile) MaxRuntime() time.Duration {
+	if p.MaximumRuntime == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(p.MaximumRuntime)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// ProcessLimits restricts the resources used by the downloader, and any
+// processes it starts, like ffmpeg. The zero value sets no limits.
+type ProcessLimits struct {
+	Nice      int     `yaml:"nice" json:"nice"`             // CPU niceness, from 1 (slightly lower priority) to 19 (lowest), 0 to leave it alone
+	IOClass   string  `yaml:"io_class" json:"io_class"`     // IO scheduling class, one of the IO_CLASS constants
+	MemoryMax string  `yaml:"memory_max" json:"memory_max"` // maximum memory, like "512M" or "2G", empty for no limit
+	CPUMax    float64 `yaml:"cpu_max" json:"cpu_max"`       // maximum CPU, in CPUs like 1.5, 0 for no limit
+}
+
+// IO scheduling classes for ProcessLimits
+const (
+	IO_CLASS_DEFAULT     = ""            // leave it alone
+	IO_CLASS_BEST_EFFORT = "best-effort" // the lowest priority of the normal class
+	IO_CLASS_IDLE        = "idle"        // only when no other process wants to use the disk
+)
+
+// IsSet reports whether any limits are set.
+func (pl ProcessLimits) IsSet() bool {
+	return pl != ProcessLimits{}
+}
+
+// MemoryBytes returns the maximum memory in bytes, or 0 if there is no limit.
+// The suffixes K, M, G and T are powers of 1024.
+func (pl ProcessLimits) MemoryBytes() (int64, error) {
+	if pl.MemoryMax == "" {
+		return 0, nil
+	}
+	s := strings.ToUpper(strings.TrimSpace(pl.MemoryMax))
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", pl.MemoryMax)
+	}
+	return n * multiplier, nil
+}
+
+// validate checks the limits for sanity
+func (pl ProcessLimits) validate(profile string) error {
+	if pl.Nice < 0 || pl.Nice > 19 {
+		return fmt.Errorf("niceness in profile '%s' must be 0-19", profile)
+	}
+	switch pl.IOClass {
+	case IO_CLASS_DEFAULT, IO_CLASS_BEST_EFFORT, IO_CLASS_IDLE:
+	default:
+		return fmt.Errorf("invalid IO class '%s' in profile '%s'", pl.IOClass, profile)
+	}
+	_, err := pl.MemoryBytes()
+	if err != nil {
+		return fmt.Errorf("%s in profile '%s'", err, profile)
+	}
+	if pl.CPUMax < 0 {
+		return fmt.Errorf("maximum CPU in profile '%s' cannot be negative", profile)
+	}
+	return nil
+}
+
+// FailureClasses are the kinds of download failure that can be recognised in
+// the downloader output. These match the failure classes in the download package.
+var FailureClasses = []string{"rate-limited", "server-error", "network", "extraction", "unavailable", "stalled", "timed-out", "unknown"}
+
+// RetryPolicy determines if and when a failed download is automatically retried
+type RetryPolicy struct {
+	MaxAttempts int      `yaml:"max_attempts" json:"max_attempts"` // total attempts, including the first. 0 or 1 means no retries
+	Backoff     []string `yaml:"backoff" json:"backoff"`           // durations to wait before each retry, the last is used for any further retries
+	Retryable   []string `yaml:"retryable" json:"retryable"`       // which of FailureClasses to retry
+}
+
+// DefaultRetryPolicy returns the retry policy used for new and migrated profiles.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     []string{"30s", "5m"},
+		Retryable:   []string{"rate-limited", "server-error", "network"},
+	}
+}
+
+// BackoffFor returns how long to wait before the given retry (starting at 1).
+func (rp RetryPolicy) BackoffFor(retry int) time.Duration {
+	if len(rp.Backoff) == 0 {
+		return 0
+	}
+	i := min(max(retry-1, 0), len(rp.Backoff)-1)
+	d, err := time.ParseDuration(rp.Backoff[i])
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// ShouldRetry reports whether a download which failed on the given attempt
+// (starting at 1), with the given failure class, should be retried.
+func (rp RetryPolicy) ShouldRetry(attempt int, class string) bool {
+	if attempt >= rp.MaxAttempts {
+		return false
+	}
+	for _, c := range rp.Retryable {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the policy for sanity
+func (rp RetryPolicy) validate(profile string) error {
+	if rp.MaxAttempts < 0 {
+		return fmt.Errorf("maximum attempts in profile '%s' cannot be < 0", profile)
+	}
+	for _, b := range rp.Backoff {
+		d, err := time.ParseDuration(b)
+		if err != nil {
+			return fmt.Errorf("invalid retry backoff '%s' in profile '%s': %s", b, profile, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("retry backoff in profile '%s' cannot be negative", profile)
+		}
+	}
+	for _, c := range rp.Retryable {
+		found := false
+		for _, valid := range FailureClasses {
+			if c == valid {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown failure class '%s' in profile '%s'", c, profile)
+		}
+	}
+	return nil
 }
 
 // DownloadOption contains configuration for extra arguments to pass to the download command
@@ -45,6 +350,272 @@ type Destination struct {
 	Path string `yaml:"path" json:"path"` // Path on disk
 }
 
+// RetentionRule determines how long one kind of finished download is kept in
+// the list before being removed.
+type RetentionRule struct {
+	KeepForever bool   `yaml:"keep_forever" json:"keep_forever"` // never remove automatically
+	MaxAge      string `yaml:"max_age" json:"max_age"`           // duration like "1h" or "72h", empty for no age limit
+	MaxCount    int    `yaml:"max_count" json:"max_count"`       // number to keep, 0 for no limit
+}
+
+// Retention holds the rules for removing finished downloads from the list
+type Retention struct {
+	Completed RetentionRule `yaml:"completed" json:"completed"`
+	Failed    RetentionRule `yaml:"failed" json:"failed"`
+	Stopped   RetentionRule `yaml:"stopped" json:"stopped"`
+}
+
+// WebhookEvents are the names of the events a webhook can be sent for. These
+// match the event types in the download package.
+var WebhookEvents = []string{"queued", "started", "progress", "file-added", "file-removed", "completed", "failed", "stopped"}
+
+// WebhookHeader is an extra HTTP header to send with a webhook
+type WebhookHeader struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// Webhook is a URL which is sent a JSON payload when certain events happen to a download
+type Webhook struct {
+	URL     string          `yaml:"url" json:"url"`
+	Events  []string        `yaml:"events" json:"events"`   // which of WebhookEvents to send
+	Headers []WebhookHeader `yaml:"headers" json:"headers"` // extra headers, for instance for authentication
+	Secret  string          `yaml:"secret" json:"secret"`   // if set, the payload is signed with HMAC-SHA256
+}
+
+// WantsEvent reports whether this webhook should be sent for the named event.
+func (w Webhook) WantsEvent(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the webhook for sanity
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL '%s'", w.URL)
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("webhook '%s' has no events selected", w.URL)
+	}
+	for _, e := range w.Events {
+		found := false
+		for _, valid := range WebhookEvents {
+			if e == valid {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("webhook '%s' has unknown event '%s'", w.URL, e)
+		}
+	}
+	for _, h := range w.Headers {
+		if strings.TrimSpace(h.Name) == "" {
+			return fmt.Errorf("webhook '%s' has a header with no name", w.URL)
+		}
+	}
+	return nil
+}
+
+// DomainRule groups hosts together for scheduling, so that downloads from any
+// of them count towards the same limits.
+type DomainRule struct {
+	Name                   string   `yaml:"name" json:"name"`
+	Hosts                  []string `yaml:"hosts" json:"hosts"`                                       // subdomains of these hosts are included
+	MaximumActiveDownloads int      `yaml:"maximum_active_downloads" json:"maximum_active_downloads"` // overrides the server maximum per domain, if not 0
+	MinimumStartDelay      string   `yaml:"minimum_start_delay" json:"minimum_start_delay"`           // minimum time between starting downloads, like "10s"
+}
+
+// DefaultDomainRules returns the domain rules used for new and migrated
+// configurations.
+func DefaultDomainRules() []DomainRule {
+	return []DomainRule{
+		{Name: "youtube", Hosts: []string{"youtube.com", "youtu.be", "youtube-nocookie.com"}},
+	}
+}
+
+// MatchesHost reports whether the host is one of the hosts of this rule, or
+// a subdomain of one.
+func (dr DomainRule) MatchesHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range dr.Hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartDelay returns the minimum time between starting downloads for this
+// rule, or 0 if there is none.
+func (dr DomainRule) StartDelay() time.Duration {
+	if dr.MinimumStartDelay == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(dr.MinimumStartDelay)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// validate checks the rule for sanity
+func (dr DomainRule) validate() error {
+	if dr.Name == "" {
+		return errors.New("domain rule name cannot be empty")
+	}
+	if len(dr.Hosts) == 0 {
+		return fmt.Errorf("domain rule '%s' has no hosts", dr.Name)
+	}
+	for _, h := range dr.Hosts {
+		if h == "" || strings.ContainsAny(h, "/: ") {
+			return fmt.Errorf("invalid host '%s' in domain rule '%s'", h, dr.Name)
+		}
+	}
+	if dr.MaximumActiveDownloads < 0 {
+		return fmt.Errorf("maximum active downloads in domain rule '%s' can not be < 0", dr.Name)
+	}
+	if dr.MinimumStartDelay != "" {
+		d, err := time.ParseDuration(dr.MinimumStartDelay)
+		if err != nil {
+			return fmt.Errorf("invalid minimum start delay '%s' in domain rule '%s': %s", dr.MinimumStartDelay, dr.Name, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("minimum start delay in domain rule '%s' cannot be negative", dr.Name)
+		}
+	}
+	return nil
+}
+
+// Schedule modes, which determine how the time windows of a Schedule are used
+const (
+	SCHEDULE_ALWAYS        = "always"        // downloads may start at any time
+	SCHEDULE_ONLY_DURING   = "only_during"   // downloads may only start during the windows
+	SCHEDULE_EXCEPT_DURING = "except_during" // downloads may not start during the windows
+)
+
+// Schedule restricts the times at which queued downloads may be started.
+// Downloads which have already started are not affected.
+type Schedule struct {
+	Mode    string       `yaml:"mode" json:"mode"`
+	Windows []TimeWindow `yaml:"windows" json:"windows"`
+}
+
+// TimeWindow is a daily period of time, in local time. If End is before Start
+// the window runs over midnight.
+type TimeWindow struct {
+	Start string `yaml:"start" json:"start"` // like "23:00"
+	End   string `yaml:"end" json:"end"`     // like "07:00"
+}
+
+// DefaultSchedule returns the schedule used for new and migrated
+// configurations, which allows downloads at any time.
+func DefaultSchedule() Schedule {
+	return Schedule{Mode: SCHEDULE_ALWAYS, Windows: []TimeWindow{}}
+}
+
+// minutes returns the start and end of the window, in minutes since midnight.
+func (tw TimeWindow) minutes() (int, int, error) {
+	start, err := time.Parse("15:04", tw.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start time '%s', should be like 23:00", tw.Start)
+	}
+	end, err := time.Parse("15:04", tw.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end time '%s', should be like 07:00", tw.End)
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// Contains reports whether the time is within the window.
+func (tw TimeWindow) Contains(t time.Time) bool {
+	start, end, err := tw.minutes()
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	// over midnight
+	return now >= start || now < end
+}
+
+// Allows reports whether downloads may be started at the time given.
+func (s Schedule) Allows(t time.Time) bool {
+	inWindow := false
+	for _, tw := range s.Windows {
+		if tw.Contains(t) {
+			inWindow = true
+			break
+		}
+	}
+	switch s.Mode {
+	case SCHEDULE_ONLY_DURING:
+		return inWindow
+	case SCHEDULE_EXCEPT_DURING:
+		return !inWindow
+	}
+	return true
+}
+
+// NextAllowed returns the first time, at or after the time given, at which
+// downloads may be started. If there is no such time, the zero time is returned.
+func (s Schedule) NextAllowed(t time.Time) time.Time {
+	if s.Allows(t) {
+		return t
+	}
+	// whether downloads are allowed only changes at the edge of a window, so
+	// check each of those over the next couple of days
+	edges := []time.Time{}
+	for day := 0; day <= 2; day++ {
+		midnight := time.Date(t.Year(), t.Month(), t.Day()+day, 0, 0, 0, 0, t.Location())
+		for _, tw := range s.Windows {
+			start, end, err := tw.minutes()
+			if err != nil {
+				continue
+			}
+			edges = append(edges,
+				midnight.Add(time.Duration(start)*time.Minute),
+				midnight.Add(time.Duration(end)*time.Minute))
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Before(edges[j]) })
+	for _, edge := range edges {
+		if edge.After(t) && s.Allows(edge) {
+			return edge
+		}
+	}
+	return time.Time{}
+}
+
+// validate checks the schedule for sanity
+func (s Schedule) validate() error {
+	switch s.Mode {
+	case SCHEDULE_ALWAYS, SCHEDULE_ONLY_DURING, SCHEDULE_EXCEPT_DURING:
+	default:
+		return fmt.Errorf("invalid schedule mode '%s'", s.Mode)
+	}
+	for _, tw := range s.Windows {
+		start, end, err := tw.minutes()
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("schedule window %s-%s is empty", tw.Start, tw.End)
+		}
+	}
+	if s.Mode == SCHEDULE_ONLY_DURING && len(s.Windows) == 0 {
+		return errors.New("schedule needs at least one window when downloads may start")
+	}
+	return nil
+}
+
 // Config is the top level of the user configuration
 type Config struct {
 	ConfigVersion    int               `yaml:"config_version" json:"config_version"`
@@ -53,6 +624,50 @@ type Config struct {
 	Destinations     []Destination     `yaml:"destinations" json:"destinations"` // no longer in use, see DownloadOptions
 	DownloadProfiles []DownloadProfile `yaml:"profiles" json:"profiles"`
 	DownloadOptions  []DownloadOption  `yaml:"download_options" json:"download_options"`
+	Retention        Retention         `yaml:"retention" json:"retention"`
+	Webhooks         []Webhook         `yaml:"webhooks" json:"webhooks"`
+	DomainRules      []DomainRule      `yaml:"domain_rules" json:"domain_rules"`
+	Schedule         Schedule          `yaml:"schedule" json:"schedule"`
+}
+
+// DefaultRetention returns the retention rules used for new and migrated
+// configurations.
+func DefaultRetention() Retention {
+	return Retention{
+		Completed: RetentionRule{MaxAge: "1h"},
+		Failed:    RetentionRule{MaxAge: "24h"},
+		Stopped:   RetentionRule{MaxAge: "1h"},
+	}
+}
+
+// MaxAgeDuration returns the maximum age for this rule, or 0 if there is
+// no age limit.
+func (rr RetentionRule) MaxAgeDuration() time.Duration {
+	if rr.MaxAge == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(rr.MaxAge)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// validate checks the rule for sanity
+func (rr RetentionRule) validate(name string) error {
+	if rr.MaxAge != "" {
+		d, err := time.ParseDuration(rr.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid maximum age '%s' for %s downloads: %s", rr.MaxAge, name, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("maximum age for %s downloads cannot be negative", name)
+		}
+	}
+	if rr.MaxCount < 0 {
+		return fmt.Errorf("maximum count for %s downloads cannot be < 0", name)
+	}
+	return nil
 }
 
 // ConfigService is a struct to handle configuration requests, allowing for the
@@ -75,13 +690,13 @@ func (cs *ConfigService) LoadDefaultConfig() {
 		"--write-info-json",
 		"-f",
 		"bestvideo[ext=mp4]+bestaudio[ext=m4a]/best[ext=mp4]/best",
-	}}
+	}, Retry: DefaultRetryPolicy()}
 	mp3Profile := DownloadProfile{Name: "standard mp3", Command: "yt-dlp", Args: []string{
 		"--newline",
 		"--write-info-json",
 		"--extract-audio",
 		"--audio-format", "mp3",
-	}}
+	}, Retry: DefaultRetryPolicy()}
 
 	defaultConfig.DownloadProfiles = append(defaultConfig.DownloadProfiles, stdProfile)
 	defaultConfig.DownloadProfiles = append(defaultConfig.DownloadProfiles, mp3Profile)
@@ -94,11 +709,22 @@ func (cs *ConfigService) LoadDefaultConfig() {
 	defaultConfig.UI.PopupHeight = 500
 
 	defaultConfig.Server.MaximumActiveDownloads = 2
+	defaultConfig.Server.ShutdownGracePeriod = DefaultShutdownGracePeriod
+	defaultConfig.Server.QueuePolicy = QUEUE_POLICY_PRIORITY
+	defaultConfig.Server.StallTimeout = DefaultStallTimeout
+	defaultConfig.Server.StopInterruptWait = DefaultStopWait
+	defaultConfig.Server.StopTerminateWait = DefaultStopWait
+	defaultConfig.Server.MaximumLogLines = DefaultMaximumLogLines
 
 	defaultConfig.Destinations = nil
 	defaultConfig.DownloadOptions = make([]DownloadOption, 0)
 
-	defaultConfig.ConfigVersion = 4
+	defaultConfig.Retention = DefaultRetention()
+	defaultConfig.Webhooks = make([]Webhook, 0)
+	defaultConfig.DomainRules = DefaultDomainRules()
+	defaultConfig.Schedule = DefaultSchedule()
+
+	defaultConfig.ConfigVersion = 13
 
 	cs.Config = &defaultConfig
 
@@ -114,6 +740,17 @@ func (c *Config) ProfileCalled(name string) *DownloadProfile {
 	return nil
 }
 
+// DomainRuleFor returns the first DomainRule which matches the host, or nil if
+// there is none.
+func (c *Config) DomainRuleFor(host string) *DomainRule {
+	for _, dr := range c.DomainRules {
+		if dr.MatchesHost(host) {
+			return &dr
+		}
+	}
+	return nil
+}
+
 // DownloadOptionCalled returns the corresponding DownloadOption, or nil if it does not exist
 func (c *Config) DownloadOptionCalled(name string) *DownloadOption {
 	for _, o := range c.DownloadOptions {
@@ -157,6 +794,91 @@ func (c *Config) UpdateFromJSON(j []byte) error {
 	if newConfig.Server.MaximumActiveDownloads < 0 {
 		return fmt.Errorf("maximum active downloads can not be < 0")
 	}
+	if newConfig.Server.MaximumActiveTotal < 0 {
+		return fmt.Errorf("maximum total active downloads can not be < 0")
+	}
+	if newConfig.Server.MaximumLogLines < 0 {
+		return fmt.Errorf("maximum log lines can not be < 0")
+	}
+
+	grace, err := time.ParseDuration(newConfig.Server.ShutdownGracePeriod)
+	if err != nil {
+		return fmt.Errorf("invalid shutdown grace period '%s': %s", newConfig.Server.ShutdownGracePeriod, err)
+	}
+	if grace < 0 {
+		return errors.New("shutdown grace period cannot be negative")
+	}
+
+	switch newConfig.Server.QueuePolicy {
+	case QUEUE_POLICY_PRIORITY, QUEUE_POLICY_FIFO, QUEUE_POLICY_ROUND_ROBIN, QUEUE_POLICY_FAIR:
+	default:
+		return fmt.Errorf("invalid queue policy '%s'", newConfig.Server.QueuePolicy)
+	}
+
+	for _, wait := range []struct{ name, value string }{
+		{"stop interrupt wait", newConfig.Server.StopInterruptWait},
+		{"stop terminate wait", newConfig.Server.StopTerminateWait},
+	} {
+		d, err := time.ParseDuration(wait.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s': %s", wait.name, wait.value, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("%s cannot be negative", wait.name)
+		}
+	}
+
+	if newConfig.Server.StallTimeout != "" {
+		stall, err := time.ParseDuration(newConfig.Server.StallTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid stall timeout '%s': %s", newConfig.Server.StallTimeout, err)
+		}
+		if stall < 0 {
+			return errors.New("stall timeout cannot be negative")
+		}
+	}
+
+	// check the retention rules
+	err = errors.Join(
+		newConfig.Retention.Completed.validate("completed"),
+		newConfig.Retention.Failed.validate("failed"),
+		newConfig.Retention.Stopped.validate("stopped"),
+	)
+	if err != nil {
+		return err
+	}
+
+	// check the webhooks
+	for i := range newConfig.Webhooks {
+		newConfig.Webhooks[i].URL = strings.TrimSpace(newConfig.Webhooks[i].URL)
+		err = newConfig.Webhooks[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// check the schedule
+	err = newConfig.Schedule.validate()
+	if err != nil {
+		return err
+	}
+
+	// check the domain rules
+	for i := range newConfig.DomainRules {
+		newConfig.DomainRules[i].Name = strings.TrimSpace(newConfig.DomainRules[i].Name)
+		for j := range newConfig.DomainRules[i].Hosts {
+			newConfig.DomainRules[i].Hosts[j] = strings.TrimSpace(newConfig.DomainRules[i].Hosts[j])
+		}
+		err = newConfig.DomainRules[i].validate()
+		if err != nil {
+			return err
+		}
+		for j := range newConfig.DomainRules[:i] {
+			if newConfig.DomainRules[j].Name == newConfig.DomainRules[i].Name {
+				return fmt.Errorf("duplicate domain rule name '%s'", newConfig.DomainRules[i].Name)
+			}
+		}
+	}
 
 	// check profile name uniqueness
 	for i, p1 := range newConfig.DownloadProfiles {
@@ -188,6 +910,44 @@ func (c *Config) UpdateFromJSON(j []byte) error {
 			}
 		}
 
+		if newConfig.DownloadProfiles[i].MaximumActiveDownloads < 0 {
+			return fmt.Errorf("maximum active downloads in profile '%s' can not be < 0", newConfig.DownloadProfiles[i].Name)
+		}
+
+		err = newConfig.DownloadProfiles[i].Retry.validate(newConfig.DownloadProfiles[i].Name)
+		if err != nil {
+			return err
+		}
+
+		if newConfig.DownloadProfiles[i].MaximumRuntime != "" {
+			runtime, err := time.ParseDuration(newConfig.DownloadProfiles[i].MaximumRuntime)
+			if err != nil {
+				return fmt.Errorf("invalid maximum runtime '%s' in profile '%s': %s", newConfig.DownloadProfiles[i].MaximumRuntime, newConfig.DownloadProfiles[i].Name, err)
+			}
+			if runtime < 0 {
+				return fmt.Errorf("maximum runtime in profile '%s' cannot be negative", newConfig.DownloadProfiles[i].Name)
+			}
+		}
+
+		err = newConfig.DownloadProfiles[i].Limits.validate(newConfig.DownloadProfiles[i].Name)
+		if err != nil {
+			return err
+		}
+
+		for j := range newConfig.DownloadProfiles[i].Patterns {
+			newConfig.DownloadProfiles[i].Patterns[j] = strings.TrimSpace(newConfig.DownloadProfiles[i].Patterns[j])
+		}
+		err = newConfig.DownloadProfiles[i].validateParser()
+		if err != nil {
+			return err
+		}
+
+		switch newConfig.DownloadProfiles[i].Cleanup {
+		case CLEANUP_NONE, CLEANUP_CONFIRM, CLEANUP_AUTOMATIC:
+		default:
+			return fmt.Errorf("invalid cleanup policy '%s' in profile '%s'", newConfig.DownloadProfiles[i].Cleanup, newConfig.DownloadProfiles[i].Name)
+		}
+
 		// check the command exists
 
 		_, err := AbsPathToExecutable(newConfig.DownloadProfiles[i].Command)
@@ -307,6 +1067,72 @@ func (cs *ConfigService) LoadConfig() error {
 		log.Print("migrated config from version 3 => 4")
 	}
 
+	if c.ConfigVersion == 4 {
+		c.Retention = DefaultRetention()
+		c.ConfigVersion = 5
+		configMigrated = true
+		log.Print("migrated config from version 4 => 5")
+	}
+
+	if c.ConfigVersion == 5 {
+		for i := range c.DownloadProfiles {
+			c.DownloadProfiles[i].Retry = DefaultRetryPolicy()
+		}
+		c.ConfigVersion = 6
+		configMigrated = true
+		log.Print("migrated config from version 5 => 6")
+	}
+
+	if c.ConfigVersion == 6 {
+		c.Server.ShutdownGracePeriod = DefaultShutdownGracePeriod
+		c.ConfigVersion = 7
+		configMigrated = true
+		log.Print("migrated config from version 6 => 7")
+	}
+
+	if c.ConfigVersion == 7 {
+		c.DomainRules = DefaultDomainRules()
+		c.ConfigVersion = 8
+		configMigrated = true
+		log.Print("migrated config from version 7 => 8")
+	}
+
+	if c.ConfigVersion == 8 {
+		c.Schedule = DefaultSchedule()
+		c.ConfigVersion = 9
+		configMigrated = true
+		log.Print("migrated config from version 8 => 9")
+	}
+
+	if c.ConfigVersion == 9 {
+		c.Server.QueuePolicy = QUEUE_POLICY_PRIORITY
+		c.ConfigVersion = 10
+		configMigrated = true
+		log.Print("migrated config from version 9 => 10")
+	}
+
+	if c.ConfigVersion == 10 {
+		c.Server.StallTimeout = DefaultStallTimeout
+		c.ConfigVersion = 11
+		configMigrated = true
+		log.Print("migrated config from version 10 => 11")
+	}
+
+	if c.ConfigVersion == 11 {
+		c.Server.StopInterruptWait = DefaultStopWait
+		c.Server.StopTerminateWait = DefaultStopWait
+		c.ConfigVersion = 12
+		configMigrated = true
+		log.Print("migrated config from version 11 => 12")
+	}
+
+	if c.ConfigVersion == 12 {
+		c.Server.MaximumLogLines = DefaultMaximumLogLines
+		c.ConfigVersion = 13
+		configMigrated = true
+		log.Print("migrated config from version 12 => 13")
+	}
+
 	if configMigrated {
 		log.Print("Writing new config after version migration")
 		cs.WriteConfig()
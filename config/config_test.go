@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,7 +42,7 @@ profiles:
 	if err != nil {
 		t.Errorf("got error when loading config: %s", err)
 	}
-	if cs.Config.ConfigVersion != 4 {
+	if cs.Config.ConfigVersion != 13 {
 		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
 	}
 	if cs.Config.Server.MaximumActiveDownloads != 2 {
@@ -87,7 +88,7 @@ profiles:
 	if err != nil {
 		t.Errorf("got error when loading config: %s", err)
 	}
-	if cs.Config.ConfigVersion != 4 {
+	if cs.Config.ConfigVersion != 13 {
 		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
 	}
 	if cs.Config.Server.MaximumActiveDownloads != 2 {
@@ -145,7 +146,7 @@ profiles:
 	if err != nil {
 		t.Errorf("got error when loading config: %s", err)
 	}
-	if cs.Config.ConfigVersion != 4 {
+	if cs.Config.ConfigVersion != 13 {
 		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
 	}
 	if cs.Config.Server.MaximumActiveDownloads != 2 {
@@ -165,6 +166,416 @@ profiles:
 	os.Remove(cs.ConfigPath)
 }
 
+func TestMigrateV4toV5(t *testing.T) {
+	v4Config := `config_version: 4
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v4Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, DefaultRetention(), cs.Config.Retention)
+	assert.Equal(t, time.Hour, cs.Config.Retention.Completed.MaxAgeDuration())
+	assert.False(t, cs.Config.Retention.Failed.KeepForever)
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV5toV6(t *testing.T) {
+	v5Config := `config_version: 5
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+  - name: standard mp3
+    command: yt-dlp
+    args:
+      - --extract-audio
+download_options: []
+retention:
+  completed:
+    max_age: 2h
+`
+	cs := configServiceFromString(v5Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, "2h", cs.Config.Retention.Completed.MaxAge)
+	for _, p := range cs.Config.DownloadProfiles {
+		assert.Equal(t, DefaultRetryPolicy(), p.Retry)
+	}
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV6toV7(t *testing.T) {
+	v6Config := `config_version: 6
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v6Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, "30s", cs.Config.Server.ShutdownGracePeriod)
+	assert.Equal(t, 30*time.Second, cs.Config.Server.ShutdownGrace())
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV7toV8(t *testing.T) {
+	v7Config := `config_version: 7
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+  shutdown_grace_period: 10s
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v7Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, "10s", cs.Config.Server.ShutdownGracePeriod)
+	assert.Equal(t, DefaultDomainRules(), cs.Config.DomainRules)
+	os.Remove(cs.ConfigPath)
+}
+
+func TestDomainRules(t *testing.T) {
+	c := Config{DomainRules: []DomainRule{
+		{Name: "youtube", Hosts: []string{"youtube.com", "youtu.be"}, MinimumStartDelay: "10s"},
+		{Name: "example", Hosts: []string{"Example.org"}},
+	}}
+
+	for host, want := range map[string]string{
+		"youtube.com":      "youtube",
+		"www.youtube.com":  "youtube",
+		"m.youtube.com":    "youtube",
+		"youtu.be":         "youtube",
+		"notyoutube.com":   "",
+		"sub.example.org":  "example",
+		"EXAMPLE.ORG":      "example",
+		"example.org.evil": "",
+	} {
+		dr := c.DomainRuleFor(host)
+		if want == "" {
+			assert.Nil(t, dr, host)
+		} else if assert.NotNil(t, dr, host) {
+			assert.Equal(t, want, dr.Name, host)
+		}
+	}
+
+	assert.Equal(t, 10*time.Second, c.DomainRules[0].StartDelay())
+	assert.Equal(t, time.Duration(0), c.DomainRules[1].StartDelay())
+
+	assert.NoError(t, c.DomainRules[0].validate())
+	assert.Error(t, DomainRule{Name: "none"}.validate(), "no hosts")
+	assert.Error(t, DomainRule{Hosts: []string{"a.com"}}.validate(), "no name")
+	assert.Error(t, DomainRule{Name: "url", Hosts: []string{"https://a.com/"}}.validate())
+	assert.Error(t, DomainRule{Name: "delay", Hosts: []string{"a.com"}, MinimumStartDelay: "later"}.validate())
+	assert.Error(t, DomainRule{Name: "max", Hosts: []string{"a.com"}, MaximumActiveDownloads: -1}.validate())
+}
+
+func TestMigrateV8toV9(t *testing.T) {
+	v8Config := `config_version: 8
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+domain_rules: []
+`
+	cs := configServiceFromString(v8Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Empty(t, cs.Config.DomainRules)
+	assert.Equal(t, DefaultSchedule(), cs.Config.Schedule)
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV9toV10(t *testing.T) {
+	v9Config := `config_version: 9
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+schedule:
+  mode: always
+  windows: []
+`
+	cs := configServiceFromString(v9Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, QUEUE_POLICY_PRIORITY, cs.Config.Server.QueuePolicy)
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV10toV11(t *testing.T) {
+	v10Config := `config_version: 10
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+  queue_policy: fifo
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v10Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, QUEUE_POLICY_FIFO, cs.Config.Server.QueuePolicy)
+	assert.Equal(t, 30*time.Minute, cs.Config.Server.StallTimeoutDuration())
+	assert.Equal(t, time.Duration(0), cs.Config.DownloadProfiles[0].MaxRuntime(), "no limit by default")
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV11toV12(t *testing.T) {
+	v11Config := `config_version: 11
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+  stall_timeout: 1h
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v11Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, time.Hour, cs.Config.Server.StallTimeoutDuration())
+	assert.Equal(t, 5*time.Second, cs.Config.Server.InterruptWait())
+	assert.Equal(t, 5*time.Second, cs.Config.Server.TerminateWait())
+	os.Remove(cs.ConfigPath)
+}
+
+func TestMigrateV12toV13(t *testing.T) {
+	v12Config := `config_version: 12
+server:
+  port: 6123
+  address: http://localhost:6123
+  download_path: /tmp/Downloads
+  maximum_active_downloads_per_domain: 2
+  stop_interrupt_wait: 10s
+ui:
+  popup_width: 900
+  popup_height: 900
+profiles:
+  - name: standard video
+    command: yt-dlp
+    args:
+      - --newline
+download_options: []
+`
+	cs := configServiceFromString(v12Config)
+	err := cs.LoadConfig()
+	if err != nil {
+		t.Errorf("got error when loading config: %s", err)
+	}
+	if cs.Config.ConfigVersion != 13 {
+		t.Errorf("did not migrate version (it is '%d')", cs.Config.ConfigVersion)
+	}
+	assert.Equal(t, 10*time.Second, cs.Config.Server.InterruptWait())
+	assert.Equal(t, DefaultMaximumLogLines, cs.Config.Server.MaximumLogLines)
+	os.Remove(cs.ConfigPath)
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 10, hour, minute, 0, 0, time.Local)
+	}
+
+	night := Schedule{Mode: SCHEDULE_ONLY_DURING, Windows: []TimeWindow{{Start: "23:00", End: "07:00"}}}
+	assert.NoError(t, night.validate())
+	assert.True(t, night.Allows(at(23, 30)))
+	assert.True(t, night.Allows(at(2, 0)))
+	assert.False(t, night.Allows(at(7, 0)))
+	assert.False(t, night.Allows(at(12, 0)))
+	assert.Equal(t, at(23, 0), night.NextAllowed(at(12, 0)))
+	assert.Equal(t, at(2, 0), night.NextAllowed(at(2, 0)))
+
+	quiet := Schedule{Mode: SCHEDULE_EXCEPT_DURING, Windows: []TimeWindow{{Start: "09:00", End: "17:00"}, {Start: "16:00", End: "18:30"}}}
+	assert.NoError(t, quiet.validate())
+	assert.True(t, quiet.Allows(at(8, 59)))
+	assert.False(t, quiet.Allows(at(9, 0)))
+	assert.False(t, quiet.Allows(at(17, 30)))
+	assert.Equal(t, at(18, 30), quiet.NextAllowed(at(10, 0)), "overlapping windows")
+
+	assert.True(t, DefaultSchedule().Allows(at(12, 0)))
+	assert.True(t, Schedule{}.Allows(at(12, 0)))
+
+	assert.Error(t, Schedule{Mode: "sometimes"}.validate())
+	assert.Error(t, Schedule{Mode: SCHEDULE_ONLY_DURING}.validate(), "no windows")
+	assert.Error(t, Schedule{Mode: SCHEDULE_ALWAYS, Windows: []TimeWindow{{Start: "25:00", End: "07:00"}}}.validate())
+	assert.Error(t, Schedule{Mode: SCHEDULE_ALWAYS, Windows: []TimeWindow{{Start: "07:00", End: "07:00"}}}.validate())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	rp := RetryPolicy{MaxAttempts: 3, Backoff: []string{"10s", "1m"}, Retryable: []string{"network"}}
+	assert.NoError(t, rp.validate("test"))
+
+	assert.True(t, rp.ShouldRetry(1, "network"))
+	assert.True(t, rp.ShouldRetry(2, "network"))
+	assert.False(t, rp.ShouldRetry(3, "network"), "no attempts left")
+	assert.False(t, rp.ShouldRetry(1, "unavailable"), "not a retryable class")
+
+	assert.Equal(t, 10*time.Second, rp.BackoffFor(1))
+	assert.Equal(t, time.Minute, rp.BackoffFor(2))
+	assert.Equal(t, time.Minute, rp.BackoffFor(5), "last backoff is reused")
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.BackoffFor(1))
+	assert.False(t, RetryPolicy{}.ShouldRetry(1, "network"))
+
+	assert.Error(t, RetryPolicy{Backoff: []string{"soon"}}.validate("test"))
+	assert.Error(t, RetryPolicy{Retryable: []string{"cosmic-rays"}}.validate("test"))
+	assert.Error(t, RetryPolicy{MaxAttempts: -1}.validate("test"))
+}
+
+func TestProcessLimits(t *testing.T) {
+	assert.False(t, ProcessLimits{}.IsSet())
+	assert.True(t, ProcessLimits{Nice: 10}.IsSet())
+
+	for memory, want := range map[string]int64{"": 0, "1024": 1024, "512K": 512 << 10, "512M": 512 << 20, "2g": 2 << 30} {
+		got, err := ProcessLimits{MemoryMax: memory}.MemoryBytes()
+		assert.NoError(t, err, memory)
+		assert.Equal(t, want, got, memory)
+	}
+	_, err := ProcessLimits{MemoryMax: "lots"}.MemoryBytes()
+	assert.Error(t, err)
+
+	assert.NoError(t, ProcessLimits{Nice: 19, IOClass: IO_CLASS_IDLE, MemoryMax: "1G", CPUMax: 1.5}.validate("test"))
+	assert.Error(t, ProcessLimits{Nice: 20}.validate("test"))
+	assert.Error(t, ProcessLimits{Nice: -5}.validate("test"), "cannot raise priority")
+	assert.Error(t, ProcessLimits{IOClass: "realtime"}.validate("test"))
+	assert.Error(t, ProcessLimits{MemoryMax: "-1G"}.validate("test"))
+	assert.Error(t, ProcessLimits{CPUMax: -1}.validate("test"))
+}
+
+func TestValidateParser(t *testing.T) {
+	assert.NoError(t, DownloadProfile{Name: "test"}.validateParser(), "yt-dlp is the default")
+	assert.NoError(t, DownloadProfile{Name: "test", Parser: PARSER_WGET}.validateParser())
+	assert.Error(t, DownloadProfile{Name: "test", Parser: "curl"}.validateParser())
+	assert.Error(t, DownloadProfile{Name: "test", Parser: PARSER_WGET, TrackFiles: true}.validateParser(), "only yt-dlp can track files")
+
+	custom := func(patterns ...string) DownloadProfile {
+		return DownloadProfile{Name: "test", Parser: PARSER_CUSTOM, Patterns: patterns}
+	}
+	assert.NoError(t, custom(`(?P<percent>[\d.]+)% ETA (?P<eta>\S+)`, `^Saved (?P<file>.+)$`).validateParser())
+	assert.Error(t, custom().validateParser(), "needs patterns")
+	assert.Error(t, custom(`(?P<percent>[\d.]+%`).validateParser(), "does not compile")
+	assert.Error(t, custom(`(?P<speed>\S+)/s`).validateParser(), "unknown group")
+	assert.Error(t, custom(`([\d.]+)%`).validateParser(), "no named groups")
+}
+
 func configServiceFromString(configString string) *ConfigService {
 	tmpFile, _ := os.CreateTemp("", "gropple_test_*.yml")
 	_, err1 := tmpFile.Write([]byte(configString))
@@ -218,3 +629,15 @@ func TestLookForExecutable(t *testing.T) {
 	}
 
 }
+
+func TestWebhookValidate(t *testing.T) {
+	good := Webhook{URL: "https://example.org/hook", Events: []string{"completed", "failed"}}
+	assert.NoError(t, good.validate())
+	assert.True(t, good.WantsEvent("failed"))
+	assert.False(t, good.WantsEvent("progress"))
+
+	assert.Error(t, Webhook{URL: "ftp://example.org/", Events: []string{"failed"}}.validate())
+	assert.Error(t, Webhook{URL: "https://example.org/"}.validate(), "no events")
+	assert.Error(t, Webhook{URL: "https://example.org/", Events: []string{"exploded"}}.validate())
+	assert.Error(t, Webhook{URL: "https://example.org/", Events: []string{"failed"}, Headers: []WebhookHeader{{Name: " ", Value: "x"}}}.validate())
+}
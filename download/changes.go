@@ -0,0 +1,178 @@
+package download
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Change describes an update to a single Download. Changes are sent to
+// subscribers as they happen, so that clients do not need to repeatedly
+// fetch the entire list.
+type Change struct {
+	Id              int            `json:"id"`
+	Url             string         `json:"url"`
+	PopupUrl        string         `json:"popup_url"`
+	State           State          `json:"state"`
+	Finished        bool           `json:"finished"`
+	ExitCode        int            `json:"exit_code"`
+	Percent         float32        `json:"percent"`
+	Eta             string         `json:"eta"`
+	DownloadedBytes int64          `json:"downloaded_bytes,omitempty"`
+	TotalBytes      int64          `json:"total_bytes,omitempty"`
+	TotalEstimated  bool           `json:"total_estimated,omitempty"`
+	Speed           float64        `json:"speed,omitempty"`
+	FragmentIndex   int            `json:"fragment_index,omitempty"`
+	FragmentCount   int            `json:"fragment_count,omitempty"`
+	SpeedHistory    *[]SpeedSample `json:"speed_history,omitempty"` // the whole history, only when it has changed since the previous change
+	PlaylistCurrent int            `json:"playlist_current"`
+	PlaylistTotal   int            `json:"playlist_total"`
+	Files           []string       `json:"files"`
+	OutputFiles     []OutputFile   `json:"output_files,omitempty"`
+	Priority        int            `json:"priority"`
+	Attempt         int            `json:"attempt"`
+	FailureReason   *FailureReason `json:"failure_reason,omitempty"`
+	Waiting         WaitReason     `json:"waiting,omitempty"`
+	StartAfter      *time.Time     `json:"start_after,omitempty"`
+	PlannedStart    *time.Time     `json:"planned_start,omitempty"`
+	LogIndex        int            `json:"log_index"`              // position of the first line of Log in the full log
+	Log             []string       `json:"log,omitempty"`          // lines added since the previous change
+	LogDropped      int            `json:"log_dropped,omitempty"`  // how many of the oldest lines are no longer kept in memory
+	Removed         bool           `json:"removed,omitempty"`      // download has been removed from the list
+	Order           []int          `json:"order,omitempty"`        // ids of all downloads, when the list has been reordered
+	QueuePaused     *bool          `json:"queue_paused,omitempty"` // whether the queue is paused, when it has been paused or resumed
+}
+
+// ChangeFeed distributes Changes to any number of subscribers. Delivery never
+// blocks - a subscriber which falls behind misses changes, and is marked as
+// lagged so it can fetch the full state again.
+type ChangeFeed struct {
+	lock sync.Mutex
+	subs map[*ChangeSubscription]struct{}
+}
+
+// ChangeSubscription receives Changes on C until it is closed.
+type ChangeSubscription struct {
+	C      chan Change
+	lagged atomic.Bool
+	feed   *ChangeFeed
+}
+
+// Subscribe returns a new subscription to the feed, which must be closed
+// when no longer needed.
+func (f *ChangeFeed) Subscribe() *ChangeSubscription {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[*ChangeSubscription]struct{})
+	}
+	sub := &ChangeSubscription{C: make(chan Change, 256), feed: f}
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+// publish sends the change to all subscribers, without blocking.
+func (f *ChangeFeed) publish(c Change) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for sub := range f.subs {
+		select {
+		case sub.C <- c:
+		default:
+			sub.lagged.Store(true)
+		}
+	}
+}
+
+// Lagged reports whether any changes have been dropped since the last call,
+// because the subscriber was not keeping up.
+func (s *ChangeSubscription) Lagged() bool {
+	return s.lagged.Swap(false)
+}
+
+// Close unsubscribes from the feed and closes C.
+func (s *ChangeSubscription) Close() {
+	s.feed.lock.Lock()
+	defer s.feed.lock.Unlock()
+	if _, ok := s.feed.subs[s]; ok {
+		delete(s.feed.subs, s)
+		close(s.C)
+	}
+}
+
+// SubscribeChanges returns a subscription to changes to any Download.
+func (m *Manager) SubscribeChanges() *ChangeSubscription {
+	return m.changes.Subscribe()
+}
+
+// publishChange sends the current state of the Download, along with any log
+// lines added since the last change, to subscribers. Download must be locked.
+func (dl *Download) publishChange() {
+	if dl.feed == nil {
+		return
+	}
+	c := Change{
+		Id:              dl.Id,
+		Url:             dl.Url,
+		PopupUrl:        dl.PopupUrl,
+		State:           dl.State,
+		Finished:        dl.Finished,
+		ExitCode:        dl.ExitCode,
+		Percent:         dl.Percent,
+		Eta:             dl.Eta,
+		DownloadedBytes: dl.DownloadedBytes,
+		TotalBytes:      dl.TotalBytes,
+		TotalEstimated:  dl.TotalEstimated,
+		Speed:           dl.Speed,
+		FragmentIndex:   dl.FragmentIndex,
+		FragmentCount:   dl.FragmentCount,
+		PlaylistCurrent: dl.PlaylistCurrent,
+		PlaylistTotal:   dl.PlaylistTotal,
+		Files:           append([]string{}, dl.Files...),
+		OutputFiles:     dl.OutputFiles,
+		Priority:        dl.Priority,
+		Attempt:         dl.Attempt,
+		FailureReason:   dl.FailureReason,
+		Waiting:         dl.Waiting,
+		StartAfter:      dl.StartAfter,
+		PlannedStart:    dl.PlannedStart,
+		LogIndex:        max(dl.sentLog, dl.LogDropped),
+		LogDropped:      dl.LogDropped,
+	}
+	if !dl.historySent {
+		history := append([]SpeedSample{}, dl.SpeedHistory...)
+		c.SpeedHistory = &history
+		dl.historySent = true
+	}
+	if total := dl.LogDropped + len(dl.Log); total > dl.sentLog {
+		c.Log = append([]string{}, dl.Log[c.LogIndex-dl.LogDropped:]...)
+		dl.sentLog = total
+	}
+	dl.feed.publish(c)
+}
+
+// publishRemoved tells subscribers the Download is no longer in the list.
+// Download must be locked.
+func (dl *Download) publishRemoved() {
+	if dl.feed == nil {
+		return
+	}
+	dl.feed.publish(Change{Id: dl.Id, Url: dl.Url, PopupUrl: dl.PopupUrl, State: dl.State, Removed: true})
+}
+
+// publishOrder tells subscribers the order of the list of downloads has
+// changed. Expects the Manager to be locked.
+func (m *Manager) publishOrder() {
+	ids := make([]int, len(m.Downloads))
+	for i, dl := range m.Downloads {
+		ids[i] = dl.Id
+	}
+	m.changes.publish(Change{Order: ids})
+}
+
+// publishQueueStatus tells subscribers the queue has been paused or resumed.
+// Expects the Manager to be locked.
+func (m *Manager) publishQueueStatus() {
+	paused := m.queuePaused
+	m.changes.publish(Change{QueuePaused: &paused})
+}
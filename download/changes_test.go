@@ -0,0 +1,64 @@
+package download
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestChangeFeed(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+
+	m := Manager{}
+	sub := m.SubscribeChanges()
+	defer sub.Close()
+
+	dl := NewDownload("http://example.org/", cs.Config)
+	m.AddDownload(dl)
+
+	c := <-sub.C
+	assert.Equal(t, dl.Id, c.Id)
+	assert.Equal(t, STATE_CHOOSE_PROFILE, c.State)
+	assert.Empty(t, c.Log)
+
+	m.Queue(dl)
+	c = <-sub.C
+	assert.Equal(t, STATE_QUEUED, c.State)
+
+	dl.updateDownload(strings.NewReader("[download] Destination: file.mp4\n[download]  49.7% of ~15.72MiB at  5.83MiB/s ETA 00:07\n"))
+
+	c = <-sub.C
+	assert.Equal(t, 0, c.LogIndex)
+	assert.Equal(t, []string{"[download] Destination: file.mp4"}, c.Log)
+	assert.Equal(t, []string{"file.mp4"}, c.Files)
+
+	c = <-sub.C
+	assert.Equal(t, 1, c.LogIndex)
+	assert.Len(t, c.Log, 1)
+	assert.Equal(t, "00:07", c.Eta)
+	assert.InDelta(t, 49.7, c.Percent, 0.01)
+
+	assert.False(t, sub.Lagged())
+}
+
+func TestChangeFeedLagged(t *testing.T) {
+	feed := ChangeFeed{}
+	sub := feed.Subscribe()
+
+	for i := 0; i < cap(sub.C)+1; i++ {
+		feed.publish(Change{Id: i})
+	}
+	assert.True(t, sub.Lagged())
+	assert.False(t, sub.Lagged(), "lagged should reset once checked")
+
+	sub.Close()
+	_, open := <-sub.C
+	for open {
+		_, open = <-sub.C
+	}
+	// publishing after close must not panic
+	feed.publish(Change{Id: 1})
+}
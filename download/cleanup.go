@@ -0,0 +1,175 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// formatFileRE matches the files yt-dlp downloads each format into before
+// merging them, like "Title-id.f137.mp4".
+var formatFileRE = regexp.MustCompile(`\.f\d+\.[^.]+$`)
+
+// PartialFiles returns the partial files left behind by this download, which
+// would be removed by CleanUp. Paths are relative to the download path. It is
+// an error to ask for a download which has not been stopped or failed.
+func (dl *Download) PartialFiles() ([]string, error) {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+
+	if !dl.canCleanUp() {
+		return nil, fmt.Errorf("cannot clean up a download which is '%s'", dl.State)
+	}
+	return dl.relativeToDownloadPath(dl.partialFiles()), nil
+}
+
+// CleanUp removes the partial files left behind by this download, logging
+// each one, and returns those which were removed. It is an error to clean up
+// a download which has not been stopped or failed.
+func (dl *Download) CleanUp() ([]string, error) {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+
+	if !dl.canCleanUp() {
+		return nil, fmt.Errorf("cannot clean up a download which is '%s'", dl.State)
+	}
+	removed, err := dl.cleanUp()
+	dl.publishChange()
+	return dl.relativeToDownloadPath(removed), err
+}
+
+// canCleanUp reports whether the download has finished without completing,
+// so any files it left behind are partial. Download must be locked.
+func (dl *Download) canCleanUp() bool {
+	return dl.Finished && (dl.State == STATE_FAILED || dl.State == STATE_TIMED_OUT || dl.State == STATE_STOPPED)
+}
+
+// cleanUp removes the partial files left behind by this download, and
+// returns those which were removed. Download must be locked.
+func (dl *Download) cleanUp() ([]string, error) {
+	removed := []string{}
+	var errs []error
+	for _, path := range dl.partialFiles() {
+		name := dl.relativeToDownloadPath([]string{path})[0]
+		err := os.Remove(path)
+		if err != nil {
+			log.Printf("could not remove partial file for id: %d: %s", dl.Id, err)
+			dl.appendLog(fmt.Sprintf("could not remove partial file %s: %s", name, err))
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("removed partial file for id: %d: %s", dl.Id, path)
+		dl.appendLog(fmt.Sprintf("removed partial file %s", name))
+		removed = append(removed, path)
+	}
+	if len(removed) == 0 && len(errs) == 0 {
+		dl.appendLog("no partial files to remove")
+	}
+
+	// the format files were recorded as files of the download, but they are
+	// gone now
+	for _, f := range append([]string{}, dl.Files...) {
+		if formatFileRE.MatchString(f) && !fileExists(dl.absolutePath(f)) {
+			dl.removeFile(f)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// partialFiles finds the partial files belonging to this download, using the
+// names of its files. These are the files the downloader writes while it is
+// downloading - ".part" files and their fragments, ".ytdl" state files, the
+// ".temp" file written while merging - and the format files which would have
+// been merged. Only files within the download path are included. Download
+// must be locked.
+func (dl *Download) partialFiles() []string {
+	found := make(map[string]bool)
+	for _, f := range dl.Files {
+		path := dl.absolutePath(f)
+		if !dl.inDownloadPath(path) {
+			continue
+		}
+		dir, base := filepath.Split(path)
+		ext := filepath.Ext(base)
+		temp := strings.TrimSuffix(base, ext) + ".temp" + ext
+
+		if formatFileRE.MatchString(base) && fileExists(path) {
+			found[path] = true
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if !e.Type().IsRegular() {
+				continue
+			}
+			if strings.HasPrefix(name, base+".part") || name == base+".ytdl" || name == temp {
+				found[filepath.Join(dir, name)] = true
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// cleanUpAfterFinish removes the partial files left behind by this download
+// if it has finished without completing, and its profile says to do so
+// straight away. Download must be locked.
+func (dl *Download) cleanUpAfterFinish() {
+	if dl.DownloadProfile.Cleanup != config.CLEANUP_AUTOMATIC || !dl.canCleanUp() {
+		return
+	}
+	_, _ = dl.cleanUp()
+}
+
+// absolutePath returns the path to a file written by the downloader, which
+// is relative to the download path unless it is absolute. Download must be
+// locked.
+func (dl *Download) absolutePath(f string) string {
+	if filepath.IsAbs(f) {
+		return filepath.Clean(f)
+	}
+	return filepath.Join(dl.Config.Server.DownloadPath, f)
+}
+
+// inDownloadPath reports whether the path is within the download path.
+// Download must be locked.
+func (dl *Download) inDownloadPath(path string) bool {
+	rel, err := filepath.Rel(dl.Config.Server.DownloadPath, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// relativeToDownloadPath returns the paths relative to the download path.
+// Download must be locked.
+func (dl *Download) relativeToDownloadPath(paths []string) []string {
+	out := make([]string, 0, len(paths))
+	for _, path := range paths {
+		rel, err := filepath.Rel(dl.Config.Server.DownloadPath, path)
+		if err != nil {
+			rel = path
+		}
+		out = append(out, rel)
+	}
+	return out
+}
+
+// fileExists reports whether there is a regular file at the path.
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
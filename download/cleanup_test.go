@@ -0,0 +1,100 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestCleanUp(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	dir := t.TempDir()
+	conf.Server.DownloadPath = filepath.Join(dir, "downloads")
+
+	create := func(names ...string) {
+		for _, name := range names {
+			path := filepath.Join(conf.Server.DownloadPath, name)
+			assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			assert.NoError(t, os.WriteFile(path, []byte("partial"), 0644))
+		}
+	}
+	create(
+		"Title-x.f137.mp4.part", "Title-x.f137.mp4.part-Frag3", "Title-x.f137.mp4.ytdl",
+		"Title-x.f251.webm", "Title-x.temp.mp4",
+		"Done-y.mp4", "Other-z.mp4.part", "sub/Nested-w.mp4.part",
+		"../outside.mp4.part",
+	)
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.Files = []string{"Title-x.f137.mp4", "Title-x.f251.webm", "Title-x.mp4", "Done-y.mp4", "sub/Nested-w.mp4", "../outside.mp4"}
+	dl.State = STATE_DOWNLOADING
+
+	_, err := dl.PartialFiles()
+	assert.Error(t, err, "still running")
+
+	dl.State = STATE_STOPPED
+	dl.Finished = true
+	partial := []string{
+		"Title-x.f137.mp4.part", "Title-x.f137.mp4.part-Frag3", "Title-x.f137.mp4.ytdl",
+		"Title-x.f251.webm", "Title-x.temp.mp4", "sub/Nested-w.mp4.part",
+	}
+	files, err := dl.PartialFiles()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, partial, files)
+	assert.FileExists(t, filepath.Join(conf.Server.DownloadPath, "Title-x.f137.mp4.part"), "dry run removes nothing")
+
+	files, err = dl.CleanUp()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, partial, files)
+	for _, f := range partial {
+		assert.NoFileExists(t, filepath.Join(conf.Server.DownloadPath, f))
+	}
+	assert.FileExists(t, filepath.Join(conf.Server.DownloadPath, "Done-y.mp4"), "finished files are kept")
+	assert.FileExists(t, filepath.Join(conf.Server.DownloadPath, "Other-z.mp4.part"), "other downloads are left alone")
+	assert.FileExists(t, filepath.Join(dir, "outside.mp4.part"), "nothing outside the download path is removed")
+
+	assert.Contains(t, dl.Log, "removed partial file Title-x.f137.mp4.part")
+	assert.Equal(t, []string{"Title-x.mp4", "Done-y.mp4", "sub/Nested-w.mp4", "../outside.mp4"}, dl.Files, "removed format files are no longer files of the download")
+
+	files, err = dl.CleanUp()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	assert.Equal(t, "no partial files to remove", dl.Log[len(dl.Log)-1])
+}
+
+func TestCleanUpAutomatic(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.DownloadPath = t.TempDir()
+
+	m := &Manager{Config: conf}
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{
+		Name: "failing", Command: "/bin/sh", Cleanup: config.CLEANUP_AUTOMATIC,
+		Args: []string{"-c", "echo '[download] Destination: a.mp4'; touch a.mp4.part; exit 1"},
+	}
+	m.AddDownload(dl)
+	m.Queue(dl)
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		dl.Lock.Lock()
+		defer dl.Lock.Unlock()
+		return dl.State == STATE_FAILED
+	}, time.Second, 10*time.Millisecond)
+
+	dl.Lock.Lock()
+	assert.Contains(t, dl.Log, "removed partial file a.mp4.part")
+	dl.Lock.Unlock()
+	assert.NoFileExists(t, filepath.Join(conf.Server.DownloadPath, "a.mp4.part"))
+}
@@ -1,7 +1,9 @@
 package download
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,8 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -29,28 +30,85 @@ type Download struct {
 	DownloadProfile config.DownloadProfile `json:"download_profile"`
 	DownloadOption  *config.DownloadOption `json:"download_option"`
 	Finished        bool                   `json:"finished"`
+	CreatedTS       time.Time              `json:"created_ts"`
+	StartedTS       time.Time              `json:"started_ts"`
 	FinishedTS      time.Time              `json:"finished_ts"`
 	Files           []string               `json:"files"`
 	PlaylistCurrent int                    `json:"playlist_current"`
 	PlaylistTotal   int                    `json:"playlist_total"`
 	Eta             string                 `json:"eta"`
 	Percent         float32                `json:"percent"`
+	DownloadedBytes int64                  `json:"downloaded_bytes,omitempty"` // only known with yt-dlp
+	TotalBytes      int64                  `json:"total_bytes,omitempty"`      // only known with yt-dlp
+	TotalEstimated  bool                   `json:"total_estimated,omitempty"`  // the total bytes is an estimate, as for fragmented downloads
+	Speed           float64                `json:"speed,omitempty"`            // bytes per second, only known with yt-dlp
+	FragmentIndex   int                    `json:"fragment_index,omitempty"`   // only known with yt-dlp
+	FragmentCount   int                    `json:"fragment_count,omitempty"`   // only known with yt-dlp
+	SpeedHistory    []SpeedSample          `json:"speed_history"`              // the speed and progress over the current attempt, see recordSpeed
+	OutputFiles     []OutputFile           `json:"output_files,omitempty"`     // the files, checked when the download completed, if the profile tracks files
 	Log             []string               `json:"log"`
-	Config          *config.Config
-	Lock            sync.Mutex
+	LogDropped      int                    `json:"log_dropped,omitempty"` // how many of the oldest lines are no longer kept in Log, to stay within the maximum in the config
+	ClonedFrom      int                    `json:"cloned_from,omitempty"` // id of the download this was cloned from
+	Priority        int                    `json:"priority"`              // queued downloads with a higher priority are started first
+	Batch           int                    `json:"batch"`                 // downloads submitted together share a batch, which is the id of the first of them
+	Attempt         int                    `json:"attempt"`               // how many times the downloader has been started
+	NotBefore       time.Time              `json:"not_before"`            // do not start again before this time, when waiting to retry
+	FailureReason   *FailureReason         `json:"failure_reason,omitempty"`
+	Waiting         WaitReason             `json:"waiting,omitempty"`       // why a queued download has not started yet
+	StartAfter      *time.Time             `json:"start_after,omitempty"`   // do not start before this time, if set
+	PlannedStart    *time.Time             `json:"planned_start,omitempty"` // when a download waiting on a start time or the schedule should start
+	LastActivity    time.Time              `json:"last_activity"`           // when the downloader last made progress
+	Config          *config.Config         `json:"-"`
+	Lock            sync.Mutex             `json:"-"`
+
+	stopRequested bool             // set when the user asks for the download to be stopped
+	pausedByQueue bool             // set when the download was paused along with the queue
+	interrupted   bool             // set when the download is stopped because we are shutting down
+	pausedFrom    State            // the state to return to when resumed
+	pausedAt      time.Time        // when the download was last paused
+	pausedTotal   time.Duration    // how long the current attempt has spent paused
+	timedOut      *FailureReason   // set when the watchdog kills the download
+	exited        chan struct{}    // closed when the downloader process has exited
+	finalFiles    []string         // final paths printed by the downloader, if the profile tracks files
+	parser        Parser           // understands the output of the downloader, set when it is started
+	sampleLength  time.Duration    // the time covered by each sample in the speed history
+	sampleCount   int              // how many readings have been averaged into the latest sample
+	historySent   bool             // the speed history has not changed since it was last published
+	attemptLog    int              // index in the full log of the first line of the current attempt
+	logDir        string           // where the log file is written, set when added to the Manager
+	logFile       *os.File         // the log file, kept open while the downloader is running
+	feed          *ChangeFeed      // where to publish changes, set when added to the Manager
+	bus           *EventBus        // where to publish lifecycle events, set when added to the Manager
+	wake          chan struct{}    // wakes the scheduler, set when added to the Manager
+	clock         func() time.Time // the Manager's clock, set when added to the Manager
+	sentLog       int              // number of lines of the full log already published
 }
 
 // The Manager holds and is responsible for all Download objects.
 type Manager struct {
 	Downloads    []*Download
-	MaxPerDomain int
+	MaxPerDomain int // maximum active downloads per domain when there is no config, 0 for no limit
+	MaxTotal     int // maximum active downloads across all domains when there is no config, 0 for no limit
+	Config       *config.Config
+	Store        *Store
+	LogDir       string // where the full log of each download is written, empty to only keep the logs in memory
 	Lock         sync.Mutex
+	Events       EventBus
+
+	changes      ChangeFeed
+	lastStart    map[string]time.Time // when a download was last started, for each domain group
+	lastBatch    map[int]time.Time    // when a download was last started, for each batch with downloads queued
+	clock        func() time.Time     // the current time, replaced in tests
+	running      sync.WaitGroup       // downloads which have been started and not yet returned
+	shuttingDown bool                 // no new downloads are started once this is set
+	queuePaused  bool                 // no new downloads are started while this is set
+	wake         chan struct{}        // wakes the scheduler, see wakeup
 }
 
 func (m *Manager) String() string {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
-	out := fmt.Sprintf("Max per domain: %d, downloads: %d\n", m.MaxPerDomain, len(m.Downloads))
+	out := fmt.Sprintf("Max per domain: %d, max total: %d, downloads: %d\n", m.MaxPerDomain, m.MaxTotal, len(m.Downloads))
 
 	for _, dl := range m.Downloads {
 		out = out + fmt.Sprintf("%3d: (%10s) %30s\n", dl.Id, dl.State, dl.Url)
@@ -69,25 +127,32 @@ const (
 	STATE_DOWNLOADING          State = "Downloading"
 	STATE_DOWNLOADING_METADATA State = "Downloading metadata"
 	STATE_FAILED               State = "Failed"
+	STATE_FIXING_MPEG_TS       State = "Fixing MPEG-TS in MP4"
+	STATE_PAUSED               State = "Paused"
+	STATE_TIMED_OUT            State = "Timed out"
+	STATE_STOPPED              State = "Stopped"
 	STATE_COMPLETE             State = "Complete"
 	STATE_MOVED                State = "Moved"
 )
 
-var CanStopDownload = false
-
-var downloadId int32 = 0
+// WaitReason explains why a queued download has not been started yet.
+type WaitReason string
 
-func (m *Manager) ManageQueue() {
-	for {
-		m.Lock.Lock()
+const (
+	WAIT_QUEUE_PAUSED  WaitReason = "queue paused"
+	WAIT_RETRY_BACKOFF WaitReason = "retry backoff"
+	WAIT_START_AFTER   WaitReason = "start time"
+	WAIT_SCHEDULE      WaitReason = "schedule"
+	WAIT_GLOBAL_LIMIT  WaitReason = "global limit"
+	WAIT_PROFILE_LIMIT WaitReason = "profile limit"
+	WAIT_DOMAIN_LIMIT  WaitReason = "domain limit"
+	WAIT_START_DELAY   WaitReason = "domain start delay"
+)
 
-		m.startQueued(m.MaxPerDomain)
-		m.cleanup()
-		m.Lock.Unlock()
+var CanStopDownload = false
+var CanPauseDownload = false
 
-		time.Sleep(time.Second)
-	}
-}
+var downloadId int32 = 0
 
 func (m *Manager) DownloadsAsJSON() ([]byte, error) {
 
@@ -101,59 +166,255 @@ func (m *Manager) DownloadsAsJSON() ([]byte, error) {
 	return b, err
 }
 
-// startQueued starts any downloads that have been queued, we would not exceed
-// maxRunning. If maxRunning is 0, there is no limit.
-func (m *Manager) startQueued(maxRunning int) {
+// startQueued starts queued downloads, in the order chosen by the queue
+// policy in the config. Nothing is started while the queue is paused or once
+// we are shutting down. A download waits if it is backing off before a retry,
+// if its start time has not arrived, or if the schedule in the config does not
+// allow downloads now. It also waits if starting it would exceed the total
+// limit, the limit for its profile, or the limit for its domain, or if its
+// domain started a download too recently. Domains are grouped, with their own
+// limits and start delays, by the domain rules in the config. For each limit,
+// 0 means no limit. The total and per-domain limits are read from the config
+// on every call, so changes apply straight away, with MaxTotal and maxRunning
+// used when there is no config. Downloads which wait are marked with the
+// reason. Expects the Manager to be locked.
+//
+// It returns the next time at which a download which is waiting could start,
+// or the zero time if none are waiting on a time.
+func (m *Manager) startQueued(maxRunning int) time.Time {
+	if m.shuttingDown {
+		return time.Time{}
+	}
 
 	active := make(map[string]int)
+	activeProfile := make(map[string]int)
+	activeTotal := 0
+	queued := []candidate{}
+	byId := make(map[int]*Download)
 
 	for _, dl := range m.Downloads {
 		dl.Lock.Lock()
 
-		if dl.State == STATE_DOWNLOADING || dl.State == STATE_PREPARING {
-			active[dl.domain()]++
+		group, _ := dl.domainGroup()
+		if dl.isActive() {
+			active[group]++
+			activeProfile[dl.DownloadProfile.Name]++
+			activeTotal++
+		}
+		if dl.State == STATE_QUEUED {
+			queued = append(queued, candidate{
+				id:             dl.Id,
+				group:          group,
+				batch:          dl.Batch,
+				priority:       dl.Priority,
+				lastStart:      m.lastStart[group],
+				batchLastStart: m.lastBatch[dl.Batch],
+			})
+			byId[dl.Id] = dl
 		}
 		dl.Lock.Unlock()
 
 	}
 
-	for _, dl := range m.Downloads {
+	// forget about batches which have nothing left to start
+	batches := make(map[int]bool)
+	for _, c := range queued {
+		batches[c.batch] = true
+	}
+	for batch := range m.lastBatch {
+		if !batches[batch] {
+			delete(m.lastBatch, batch)
+		}
+	}
+
+	now := m.now()
+	var next time.Time
+	schedule := config.DefaultSchedule()
+	policy := policyFor(config.QUEUE_POLICY_PRIORITY)
+	maxTotal := m.MaxTotal
+	if m.Config != nil {
+		schedule = m.Config.Schedule
+		policy = policyFor(m.Config.Server.QueuePolicy)
+		maxRunning = m.Config.Server.MaximumActiveDownloads
+		maxTotal = m.Config.Server.MaximumActiveTotal
+	}
+
+	for _, c := range policy.order(queued) {
+		dl := byId[c.id]
 
 		dl.Lock.Lock()
 
-		if dl.State == STATE_QUEUED && (maxRunning == 0 || active[dl.domain()] < maxRunning) {
-			dl.State = STATE_PREPARING
-			active[dl.domain()]++
+		if dl.State != STATE_QUEUED {
+			dl.Lock.Unlock()
+			continue
+		}
+
+		var waiting WaitReason
+		var planned time.Time
+		var retry time.Time // when it is worth looking at this download again
+		profileMax := dl.DownloadProfile.MaximumActiveDownloads
+		group, rule := dl.domainGroup()
+		domainMax := maxRunning
+		var startDelay time.Duration
+		if rule != nil {
+			if rule.MaximumActiveDownloads > 0 {
+				domainMax = rule.MaximumActiveDownloads
+			}
+			startDelay = rule.StartDelay()
+		}
+		switch {
+		case m.queuePaused:
+			waiting = WAIT_QUEUE_PAUSED
+		case now.Before(dl.NotBefore):
+			waiting = WAIT_RETRY_BACKOFF
+			retry = dl.NotBefore
+		case dl.StartAfter != nil && now.Before(*dl.StartAfter):
+			waiting = WAIT_START_AFTER
+			planned = schedule.NextAllowed(*dl.StartAfter)
+			retry = *dl.StartAfter
+		case !schedule.Allows(now):
+			waiting = WAIT_SCHEDULE
+			planned = schedule.NextAllowed(now)
+			retry = planned
+		case maxTotal > 0 && activeTotal >= maxTotal:
+			waiting = WAIT_GLOBAL_LIMIT
+		case profileMax > 0 && activeProfile[dl.DownloadProfile.Name] >= profileMax:
+			waiting = WAIT_PROFILE_LIMIT
+		case domainMax > 0 && active[group] >= domainMax:
+			waiting = WAIT_DOMAIN_LIMIT
+		case startDelay > 0 && now.Sub(m.lastStart[group]) < startDelay:
+			waiting = WAIT_START_DELAY
+			retry = m.lastStart[group].Add(startDelay)
+		}
+
+		if waiting != "" {
+			next = soonest(next, retry)
+			if dl.Waiting != waiting || !dl.plannedFor(planned) {
+				dl.Waiting = waiting
+				dl.PlannedStart = nil
+				if !planned.IsZero() {
+					dl.PlannedStart = &planned
+				}
+				dl.publishChange()
+			}
+			dl.Lock.Unlock()
+		} else {
+			dl.Waiting = ""
+			dl.PlannedStart = nil
+			_ = dl.setState(STATE_PREPARING)
+			active[group]++
+			if m.lastStart == nil {
+				m.lastStart = make(map[string]time.Time)
+				m.lastBatch = make(map[int]time.Time)
+			}
+			m.lastStart[group] = now
+			m.lastBatch[dl.Batch] = now
+			activeProfile[dl.DownloadProfile.Name]++
+			activeTotal++
 			log.Printf("Starting download for id:%d (%s)", dl.Id, dl.Url)
 
+			dl.publishChange()
 			dl.Lock.Unlock()
 
+			m.running.Add(1)
 			go func(sdl *Download) {
+				defer m.running.Done()
 				sdl.Begin()
 			}(dl)
-		} else {
-			dl.Lock.Unlock()
 		}
 
 	}
 
+	return next
 }
 
-// cleanup removes old downloads from the list. Hardcoded to remove them one hour
-// completion. Expects the Manager to be locked.
-func (m *Manager) cleanup() {
-	newDLs := []*Download{}
+// cleanup removes old finished downloads from the list, according to the
+// retention rules in the config. It returns the next time at which one of
+// the remaining downloads will be old enough to remove, or the zero time if
+// none will. Expects the Manager to be locked.
+func (m *Manager) cleanup() time.Time {
+	retention := config.DefaultRetention()
+	if m.Config != nil {
+		retention = m.Config.Retention
+	}
+
+	type finished struct {
+		dl         *Download
+		finishedTS time.Time
+	}
+	byKind := make(map[string][]finished)
+	rules := make(map[string]config.RetentionRule)
+
 	for _, dl := range m.Downloads {
 		dl.Lock.Lock()
-		if dl.Finished && time.Since(dl.FinishedTS) > time.Duration(time.Hour) {
-			// do nothing
+		if dl.Finished {
+			kind, rule := dl.retentionRule(retention)
+			byKind[kind] = append(byKind[kind], finished{dl: dl, finishedTS: dl.FinishedTS})
+			rules[kind] = rule
+		}
+		dl.Lock.Unlock()
+	}
+
+	remove := make(map[*Download]bool)
+	var next time.Time
+	for kind, dls := range byKind {
+		rule := rules[kind]
+		if rule.KeepForever {
+			continue
+		}
+		// newest first, so the count limit keeps the most recent
+		sort.SliceStable(dls, func(i, j int) bool {
+			return dls[i].finishedTS.After(dls[j].finishedTS)
+		})
+		maxAge := rule.MaxAgeDuration()
+		for i, f := range dls {
+			if (maxAge > 0 && m.now().Sub(f.finishedTS) > maxAge) ||
+				(rule.MaxCount > 0 && i >= rule.MaxCount) {
+				remove[f.dl] = true
+			} else if maxAge > 0 {
+				next = soonest(next, f.finishedTS.Add(maxAge))
+			}
+		}
+	}
+
+	if len(remove) == 0 {
+		return next
+	}
+	newDLs := []*Download{}
+	for _, dl := range m.Downloads {
+		if !remove[dl] {
+			newDLs = append(newDLs, dl)
 		} else {
+			dl.Lock.Lock()
+			dl.publishRemoved()
+			dl.removeLog()
+			dl.Lock.Unlock()
+		}
+	}
+	m.Downloads = newDLs
+	return next
+}
+
+// ClearFinished removes all finished downloads from the list, regardless of
+// the retention rules. It returns the number of downloads removed.
+func (m *Manager) ClearFinished() int {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	newDLs := []*Download{}
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if !dl.Finished {
 			newDLs = append(newDLs, dl)
+		} else {
+			dl.publishRemoved()
+			dl.removeLog()
 		}
 		dl.Lock.Unlock()
-
 	}
+	removed := len(m.Downloads) - len(newDLs)
 	m.Downloads = newDLs
+	return removed
 }
 
 // GetDlById returns one of the downloads in our current list.
@@ -172,20 +433,121 @@ func (m *Manager) GetDlById(id int) (*Download, error) {
 func (m *Manager) Queue(dl *Download) {
 	dl.Lock.Lock()
 	defer dl.Lock.Unlock()
-	dl.State = STATE_QUEUED
+	_ = dl.setState(STATE_QUEUED)
+	dl.publishChange()
+}
+
+// Retry queues a failed, timed out or stopped download again, keeping the
+// existing log.
+func (dl *Download) Retry() error {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+
+	if !dl.Finished || (dl.State != STATE_FAILED && dl.State != STATE_TIMED_OUT && dl.State != STATE_STOPPED) {
+		return fmt.Errorf("cannot retry a download which is '%s'", dl.State)
+	}
+
+	dl.Finished = false
+	dl.FinishedTS = time.Time{}
+	dl.StartedTS = time.Time{}
+	dl.resetProgress()
+	dl.Files = []string{}
+	dl.Attempt = 0
+	dl.NotBefore = time.Time{}
+	dl.FailureReason = nil
+	dl.stopRequested = false
+	dl.appendLog("---------- retrying ----------")
+
+	err := dl.setState(STATE_QUEUED)
+	dl.publishChange()
+	return err
+}
+
+// resetProgress clears the details of the previous attempt, ready for another.
+// The files are kept, so the partial files of every attempt can be cleaned up,
+// even if the next attempt fails before it names them again. Download must be
+// locked.
+func (dl *Download) resetProgress() {
+	dl.ExitCode = 0
+	dl.Percent = 0
+	dl.Eta = ""
+	dl.DownloadedBytes = 0
+	dl.TotalBytes = 0
+	dl.TotalEstimated = false
+	dl.Speed = 0
+	dl.FragmentIndex = 0
+	dl.FragmentCount = 0
+	dl.SpeedHistory = nil
+	dl.sampleLength = 0
+	dl.historySent = false
+	dl.OutputFiles = nil
+	dl.finalFiles = nil
+	dl.PlaylistCurrent = 0
+	dl.PlaylistTotal = 0
+	dl.Process = nil
+	dl.timedOut = nil
+	dl.pausedByQueue = false
+}
+
+// fail handles a download whose downloader has failed, or was killed by the
+// watchdog. If the failure is one the profile says to retry, and there are
+// attempts left, it is queued again to start after the backoff delay.
+// Otherwise it is finished. Download must be locked.
+func (dl *Download) fail() {
+	final := STATE_FAILED
+	if dl.timedOut != nil {
+		dl.FailureReason = dl.timedOut
+		final = STATE_TIMED_OUT
+	} else {
+		dl.FailureReason = classifyFailure(dl.Log[min(max(dl.attemptLog-dl.LogDropped, 0), len(dl.Log)):], dl.ExitCode)
+	}
+	policy := dl.DownloadProfile.Retry
+	if !policy.ShouldRetry(dl.Attempt, string(dl.FailureReason.Class)) {
+		dl.finish(final)
+		return
+	}
+
+	wait := policy.BackoffFor(dl.Attempt)
+	dl.NotBefore = dl.now().Add(wait)
+	dl.appendLog(fmt.Sprintf("---------- %s failure, retrying in %s (attempt %d of %d) ----------", dl.FailureReason.Class, wait, dl.Attempt+1, policy.MaxAttempts))
+	dl.resetProgress()
+	if err := dl.requeue(); err != nil {
+		// it has no process now, so it cannot be left where it is
+		dl.appendLog(fmt.Sprintf("could not queue for retry: %s", err))
+		dl.finish(final)
+	}
+}
+
+// Clone creates and queues a new download for the same URL, with a possibly
+// different profile and option.
+func (m *Manager) Clone(dl *Download, profile config.DownloadProfile, option *config.DownloadOption) *Download {
+	dl.Lock.Lock()
+	newDL := NewDownload(dl.Url, dl.Config)
+	newDL.ClonedFrom = dl.Id
+	newDL.Priority = dl.Priority
+	dl.Lock.Unlock()
+
+	newDL.DownloadProfile = profile
+	newDL.DownloadOption = option
+	newDL.appendLog(fmt.Sprintf("cloned from download id %d", newDL.ClonedFrom))
+	m.AddDownload(newDL)
+	m.Queue(newDL)
+	return newDL
 }
 
 func NewDownload(url string, conf *config.Config) *Download {
 	atomic.AddInt32(&downloadId, 1)
 	dl := Download{
-		Id:       int(downloadId),
-		Url:      url,
-		PopupUrl: fmt.Sprintf("/fetch/%d", int(downloadId)),
-		State:    STATE_CHOOSE_PROFILE,
-		Files:    []string{},
-		Log:      []string{},
-		Config:   conf,
-		Lock:     sync.Mutex{},
+		Id:        int(downloadId),
+		Url:       url,
+		PopupUrl:  fmt.Sprintf("/fetch/%d", int(downloadId)),
+		State:     STATE_CHOOSE_PROFILE,
+		Batch:     int(downloadId),
+		CreatedTS: time.Now(),
+		Files:     []string{},
+		Log:       []string{},
+		Config:    conf,
+		Lock:      sync.Mutex{},
 	}
 	return &dl
 }
@@ -194,29 +556,160 @@ func (m *Manager) AddDownload(dl *Download) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 	m.Downloads = append(m.Downloads, dl)
-}
 
-// func (dl *Download) AppendLog(text string) {
-// 	dl.Lock.Lock()
-// 	defer dl.Lock.Unlock()
-// 	dl.Log = append(dl.Log, text)
-// }
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	dl.feed = &m.changes
+	dl.bus = &m.Events
+	dl.wake = m.wakeup()
+	dl.clock = m.now
+	dl.startLog(m.LogDir)
+	dl.publishChange()
+}
 
-// Stop the download.
-func (dl *Download) Stop() {
+// Stop stops the download, along with any processes the downloader has
+// started. The downloader is interrupted first, then terminated and finally
+// killed if it has not exited after the waits in the config. It returns once
+// the first signal has been sent, and the download is marked as stopped once
+// the downloader has exited.
+func (dl *Download) Stop() error {
 	if !CanStopDownload {
-		log.Print("attempted to stop download on a platform that it is not currently supported on - please report this as a bug")
-		os.Exit(1)
+		return errors.New("stopping downloads is not supported on this platform")
 	}
 
-	log.Printf("stopping the download")
 	dl.Lock.Lock()
 	defer dl.Lock.Unlock()
-	dl.Log = append(dl.Log, "aborted by user")
-	err := dl.Process.Kill()
+
+	if dl.Process == nil || dl.Finished {
+		return fmt.Errorf("cannot stop a download which is '%s'", dl.State)
+	}
+	if dl.stopRequested {
+		return errors.New("download is already stopping")
+	}
+
+	log.Printf("stopping download id: %d", dl.Id)
+	dl.appendLog("aborted by user")
+	dl.stopRequested = true
+	dl.publishChange()
+
+	interruptWait, _ := time.ParseDuration(config.DefaultStopWait)
+	terminateWait := interruptWait
+	if dl.Config != nil {
+		interruptWait = dl.Config.Server.InterruptWait()
+		terminateWait = dl.Config.Server.TerminateWait()
+	}
+	go stopProcessGroup(dl.Id, dl.Process, dl.exited, interruptWait, terminateWait)
+	return nil
+}
+
+// stopProcessGroup interrupts the process group led by p, then terminates it
+// and finally kills it, until the process has exited. Each signal is sent
+// after waiting for the process to exit after the previous one.
+func stopProcessGroup(id int, p *os.Process, exited <-chan struct{}, interruptWait, terminateWait time.Duration) {
+	steps := []struct {
+		name   string
+		signal func(*os.Process) error
+		wait   time.Duration
+	}{
+		{"interrupt", interruptProcessGroup, interruptWait},
+		{"terminate", terminateProcessGroup, terminateWait},
+		{"kill", killProcessGroup, 0},
+	}
+	for i, step := range steps {
+		if i > 0 {
+			log.Printf("download id: %d has not stopped, trying to %s it", id, step.name)
+		}
+		err := step.signal(p)
+		if err != nil {
+			log.Printf("could not %s process for id: %d: %s", step.name, id, err)
+		}
+		if step.wait == 0 {
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(step.wait):
+		}
+	}
+}
+
+// Pause suspends the download, and any processes the downloader has started.
+func (dl *Download) Pause() error {
+	if !CanPauseDownload {
+		return errors.New("pausing downloads is not supported on this platform")
+	}
+
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	return dl.pause("paused by user")
+}
+
+// pause suspends the download, noting the reason in the log. Download must be
+// locked.
+func (dl *Download) pause(reason string) error {
+	if dl.Process == nil || !canTransition(dl.State, STATE_PAUSED) {
+		return fmt.Errorf("cannot pause a download which is '%s'", dl.State)
+	}
+	err := suspendProcessGroup(dl.Process)
 	if err != nil {
-		log.Printf("could not send kill to process: %s", err)
+		return fmt.Errorf("could not pause process: %w", err)
+	}
+	dl.pausedFrom = dl.State
+	dl.pausedAt = time.Now()
+	_ = dl.setState(STATE_PAUSED)
+	dl.appendLog(reason)
+	dl.publishChange()
+	return nil
+}
+
+// Resume continues a paused download.
+func (dl *Download) Resume() error {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	return dl.resume("resumed by user")
+}
+
+// resume continues a paused download, noting the reason in the log. Download
+// must be locked.
+func (dl *Download) resume(reason string) error {
+	if dl.State != STATE_PAUSED {
+		return fmt.Errorf("cannot resume a download which is '%s'", dl.State)
+	}
+	err := resumeProcessGroup(dl.Process)
+	if err != nil {
+		return fmt.Errorf("could not resume process: %w", err)
+	}
+	dl.pausedByQueue = false
+	dl.pausedTotal += time.Since(dl.pausedAt)
+	// time spent paused does not count as stalled
+	dl.LastActivity = time.Now()
+	_ = dl.setState(dl.pausedFrom)
+	dl.appendLog(reason)
+	dl.publishChange()
+	return nil
+}
+
+// isActive reports whether the download is using one of the active download
+// slots. Paused downloads do not. Download should be locked.
+func (dl *Download) isActive() bool {
+	switch dl.State {
+	case STATE_PREPARING, STATE_DOWNLOADING, STATE_DOWNLOADING_METADATA, STATE_FIXING_MPEG_TS:
+		return true
+	}
+	return false
+}
+
+// retentionRule returns the kind of finished download this is, and the rule
+// that applies to it. Download should be locked.
+func (dl *Download) retentionRule(r config.Retention) (string, config.RetentionRule) {
+	if dl.State == STATE_COMPLETE || dl.State == STATE_MOVED {
+		return "completed", r.Completed
+	}
+	if dl.State == STATE_STOPPED {
+		return "stopped", r.Stopped
 	}
+	return "failed", r.Failed
 }
 
 // domain returns a domain for this Download. Download should be locked.
@@ -232,10 +725,38 @@ func (dl *Download) domain() string {
 
 }
 
+// plannedFor reports whether the planned start of this Download is the time
+// given, where the zero time means no planned start. Download must be locked.
+func (dl *Download) plannedFor(t time.Time) bool {
+	if dl.PlannedStart == nil {
+		return t.IsZero()
+	}
+	return dl.PlannedStart.Equal(t)
+}
+
+// domainGroup returns the key used to schedule this Download, and the domain
+// rule it matches, if any. Downloads from hosts matching a rule share the name
+// of the rule as their key, others use their hostname. Download should be locked.
+func (dl *Download) domainGroup() (string, *config.DomainRule) {
+	host := dl.domain()
+	if dl.Config != nil {
+		if dr := dl.Config.DomainRuleFor(host); dr != nil {
+			return dr.Name, dr
+		}
+	}
+	return host, nil
+}
+
 // Begin starts a download, by starting the command specified in the DownloadProfile.
 // It blocks until the download is complete.
 func (dl *Download) Begin() {
 	dl.Lock.Lock()
+	if dl.interrupted {
+		// we are shutting down, leave it to be queued again on the next start
+		dl.Lock.Unlock()
+		return
+	}
+
 	u, err := url.Parse(dl.Url)
 	if err != nil {
 		log.Printf("Bad url '%s': %s", dl.Url, err.Error())
@@ -256,7 +777,6 @@ func (dl *Download) Begin() {
 	path = strings.ReplaceAll(path, string(filepath.Separator), "_")
 	path = strings.ReplaceAll(path, string(filepath.ListSeparator), "_")
 
-	dl.State = STATE_DOWNLOADING
 	cmdSlice := []string{}
 
 	for i := range dl.DownloadProfile.Args {
@@ -276,66 +796,91 @@ func (dl *Download) Begin() {
 		}
 	}
 
+	if dl.DownloadProfile.StructuredProgress {
+		cmdSlice = append(cmdSlice, progressTemplateArgs()...)
+	}
+	if dl.DownloadProfile.TrackFiles {
+		cmdSlice = append(cmdSlice, trackFilesArgs()...)
+	}
+
 	// only add the url if it's not empty or an example URL. This helps us with testing
 	if dl.Url != "" && !strings.Contains(dl.domain(), "example.org") {
 		cmdSlice = append(cmdSlice, dl.Url)
 	}
 
+	dl.attemptLog = dl.LogDropped + len(dl.Log)
+
+	dl.parser, err = parserFor(dl.DownloadProfile)
+	if err != nil {
+		dl.appendLog(fmt.Sprintf("could not set up the output parser, progress will not be shown: %s", err))
+	}
+
 	cmdPath, err := config.AbsPathToExecutable(dl.DownloadProfile.Command)
 	if err != nil {
-		dl.State = STATE_FAILED
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
-		dl.Log = append(dl.Log, fmt.Sprintf("error finding executable for downloader: %s", err.Error()))
+		dl.appendLog(fmt.Sprintf("error finding executable for downloader: %s", err.Error()))
+		dl.finish(STATE_FAILED)
+		dl.publishChange()
 		dl.Lock.Unlock()
 		return
 	}
 
-	dl.Log = append(dl.Log, fmt.Sprintf("executing: %s (%s) with args: %s", dl.DownloadProfile.Command, cmdPath, strings.Join(cmdSlice, " ")))
+	dl.appendLog(fmt.Sprintf("executing: %s (%s) with args: %s", dl.DownloadProfile.Command, cmdPath, strings.Join(cmdSlice, " ")))
 
 	cmd := exec.Command(cmdPath, cmdSlice...)
 	cmd.Dir = dl.Config.Server.DownloadPath
+	setProcessGroup(cmd)
 	log.Printf("Executing command executable: %s) in %s", cmdPath, dl.Config.Server.DownloadPath)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		dl.State = STATE_FAILED
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
-		dl.Log = append(dl.Log, fmt.Sprintf("error setting up stdout pipe: %v", err))
+		dl.appendLog(fmt.Sprintf("error setting up stdout pipe: %v", err))
+		dl.finish(STATE_FAILED)
+		dl.publishChange()
 		dl.Lock.Unlock()
 		return
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		dl.State = STATE_FAILED
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
-		dl.Log = append(dl.Log, fmt.Sprintf("error setting up stderr pipe: %v", err))
+		dl.appendLog(fmt.Sprintf("error setting up stderr pipe: %v", err))
+		dl.finish(STATE_FAILED)
+		dl.publishChange()
 		dl.Lock.Unlock()
 
 		return
 	}
 
-	err = cmd.Start()
+	release, problems, err := startLimited(dl.Id, cmd, dl.DownloadProfile.Limits)
+	for _, problem := range problems {
+		log.Printf("process limits for id: %d: %s", dl.Id, problem)
+		dl.appendLog(problem)
+	}
 	if err != nil {
 		log.Printf("Executing command failed: %s", err.Error())
 
-		dl.State = STATE_FAILED
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
-		dl.Log = append(dl.Log, fmt.Sprintf("error starting command '%s': %v", dl.DownloadProfile.Command, err))
+		dl.appendLog(fmt.Sprintf("error starting command '%s': %v", dl.DownloadProfile.Command, err))
+		dl.finish(STATE_FAILED)
+		dl.publishChange()
 		dl.Lock.Unlock()
 
 		return
 	}
 	dl.Process = cmd.Process
+	dl.openLog()
+	dl.StartedTS = time.Now()
+	dl.LastActivity = dl.StartedTS
+	dl.pausedTotal = 0
+	dl.Attempt++
+	dl.NotBefore = time.Time{}
+	dl.exited = make(chan struct{})
+	exited := dl.exited
+	_ = dl.setState(STATE_DOWNLOADING)
 
 	var wg sync.WaitGroup
 
 	wg.Add(2)
 
+	dl.publishChange()
 	dl.Lock.Unlock()
 
 	go func() {
@@ -351,141 +896,104 @@ func (dl *Download) Begin() {
 	wg.Wait()
 
 	err = cmd.Wait()
+	close(exited)
+	release()
 	dl.Lock.Lock()
 
-	if err != nil {
+	if err != nil && dl.interrupted {
+		// not finished, so it will be queued again on the next start
+		log.Printf("process for id: %d interrupted by shutdown", dl.Id)
+		dl.appendLog("interrupted by shutdown")
+		dl.Process = nil
+	} else if dl.stopRequested {
+		log.Printf("process stopped for id: %d", dl.Id)
+		dl.ExitCode = cmd.ProcessState.ExitCode()
+		dl.finish(STATE_STOPPED)
+	} else if err != nil {
 		log.Printf("process failed for id: %d: %s", dl.Id, err)
 
-		dl.State = STATE_FAILED
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
 		dl.ExitCode = cmd.ProcessState.ExitCode()
+		dl.fail()
 
 	} else {
 
 		log.Printf("process finished for id: %d (%v)", dl.Id, cmd)
 
-		dl.State = STATE_COMPLETE
-		dl.Finished = true
-		dl.FinishedTS = time.Now()
 		dl.ExitCode = cmd.ProcessState.ExitCode()
 
 		if dl.ExitCode != 0 {
-			dl.State = STATE_FAILED
+			dl.fail()
+		} else {
+			dl.complete()
 		}
 	}
+	dl.cleanUpAfterFinish()
+	dl.closeLog()
+	dl.publishChange()
 	dl.Lock.Unlock()
 }
 
-// updateDownload updates the download based on data from the reader. Expects the
-// Download to be unlocked.
-func (dl *Download) updateDownload(r io.Reader) {
-
-	// XXX not sure if we might get a partial line?
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Read(buf)
-		if n > 0 {
-			s := string(buf[:n])
-			lines := strings.Split(s, "\n")
-
-			for _, l := range lines {
-
-				if l == "" {
-					continue
-				}
-
-				// append the raw log
-				dl.Lock.Lock()
-				dl.Log = append(dl.Log, l)
-				// look for the percent and eta and other metadata
-				dl.updateMetadata(l)
-				dl.Lock.Unlock()
+// maxLineLength is the longest line of downloader output which is parsed.
+const maxLineLength = 1024 * 1024
 
-			}
-		}
-		if err != nil {
-			break
+// updateDownload updates the download based on data from the reader, a line at
+// a time. Lines can end with a newline or a carriage return, see
+// scanOutputLines. Expects the Download to be unlocked.
+func (dl *Download) updateDownload(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineLength)
+	scanner.Split(scanOutputLines)
+	// the last line from this output, if it can be overwritten
+	transient := -1
+	for scanner.Scan() {
+		l, cr := splitOutputLine(scanner.Bytes())
+		if l == "" {
+			continue
 		}
-	}
-}
-
-// updateMetadata parses some metadata and updates the Download. Download must be locked.
-func (dl *Download) updateMetadata(s string) {
-
-	// [download]  49.7% of ~15.72MiB at  5.83MiB/s ETA 00:07
-	// [download]  99.3% of ~1.42GiB at 320.87KiB/s ETA 00:07 (frag 212/214)
-	etaRE := regexp.MustCompile(`download.+ETA +(\d\d:\d\d(?::\d\d)?)`)
-	matches := etaRE.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		dl.Eta = matches[1]
-		dl.State = STATE_DOWNLOADING
 
+		// append the raw log
+		dl.Lock.Lock()
+		transient = dl.addOutput(l, transient, cr)
+		// look for the percent and eta and other metadata
+		dl.updateMetadata(l)
+		dl.publishChange()
+		dl.Lock.Unlock()
 	}
-
-	percentRE := regexp.MustCompile(`download.+?([\d\.]+)%`)
-	matches = percentRE.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		p, err := strconv.ParseFloat(matches[1], 32)
-		if err == nil {
-			dl.Percent = float32(p)
-		}
+	if err := scanner.Err(); err != nil {
+		log.Printf("could not read output for id: %d: %s", dl.Id, err)
+		// keep reading, so the downloader does not block writing to us
+		_, _ = io.Copy(io.Discard, r)
 	}
+}
 
-	// This appears once per destination file
-	// [download] Destination: Filename with spaces and other punctuation here be careful!.mp4
-	filename := regexp.MustCompile(`download.+?Destination: (.+)$`)
-	matches = filename.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		dl.Files = append(dl.Files, matches[1])
-	}
-
-	// This means a file has been "created" by merging others
-	// [ffmpeg] Merging formats into "Toto - Africa (Official HD Video)-FTQbiNvZqaY.mp4"
-	mergedFilename := regexp.MustCompile(`Merging formats into "(.+)"$`)
-	matches = mergedFilename.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		dl.Files = append(dl.Files, matches[1])
-	}
-
-	// This means a file has been deleted
-	// Gross - this time it's unquoted and has trailing guff
-	// Deleting original file Toto - Africa (Official HD Video)-FTQbiNvZqaY.f137.mp4 (pass -k to keep)
-	// This is very fragile
-	deletedFile := regexp.MustCompile(`Deleting original file (.+) \(pass -k to keep\)$`)
-	matches = deletedFile.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		// find the index
-		for i, f := range dl.Files {
-			if f == matches[1] {
-				dl.Files = append(dl.Files[:i], dl.Files[i+1:]...)
-				break
-			}
-		}
+// setOutputState changes the state based on the downloader output. Output which
+// was already buffered when the download was paused does not change the state.
+// Download must be locked.
+func (dl *Download) setOutputState(to State) {
+	if dl.State == STATE_PAUSED {
+		return
 	}
+	_ = dl.setState(to)
+}
 
-	// [download] Downloading video 1 of 3
-	playlistDetails := regexp.MustCompile(`Downloading video (\d+) of (\d+)`)
-	matches = playlistDetails.FindStringSubmatch(s)
-	if len(matches) == 3 {
-		total, _ := strconv.ParseInt(matches[2], 10, 32)
-		current, _ := strconv.ParseInt(matches[1], 10, 32)
-		dl.PlaylistTotal = int(total)
-		dl.PlaylistCurrent = int(current)
+// updateMetadata parses a line of output with the parser for the profile and
+// updates the Download. Download must be locked.
+func (dl *Download) updateMetadata(s string) {
+	if dl.parser == nil {
+		dl.parser = ytdlpParser{}
 	}
-
-	// [Site] user: Downloading JSON metadata page 2
-	metadataDL := regexp.MustCompile(`Downloading JSON metadata page (\d+)`)
-	matches = metadataDL.FindStringSubmatch(s)
-	if len(matches) == 2 {
-		dl.State = STATE_DOWNLOADING_METADATA
+	percent := dl.Percent
+	progress := dl.parser.Parse(dl, s)
+	if progress {
+		dl.recordSpeed(time.Now())
 	}
 
-	// [FixupM3u8] Fixing MPEG-TS in MP4 container of "file [-168849776_456239489].mp4"
-	metadataFixup := regexp.MustCompile(`Fixing MPEG-TS in MP4 container`)
-	matches = metadataFixup.FindStringSubmatch(s)
-	if len(matches) == 1 {
-		dl.State = "Fixing MPEG-TS in MP4"
+	// a downloader which is stuck may keep repeating the same percentage,
+	// but any other output means it is doing something
+	if !progress || dl.Percent != percent {
+		dl.LastActivity = time.Now()
+	}
+	if dl.Percent != percent {
+		dl.publishEvent(EVENT_PROGRESS, "")
 	}
-
 }
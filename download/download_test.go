@@ -1,11 +1,14 @@
 package download
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/tardisx/gropple/config"
 )
 
@@ -21,11 +24,11 @@ func TestUpdateMetadata(t *testing.T) {
 	// eta's might be xx:xx:xx or xx:xx
 	newD.updateMetadata("[download]   0.0% of 504.09MiB at 135.71KiB/s ETA 01:03:36")
 	if newD.Eta != "01:03:36" {
-		t.Fatalf("bad long eta in dl\n%#v", newD) //nolint
+		t.Fatalf("bad long eta in dl\n%#v", &newD) //nolint
 	}
 	newD.updateMetadata("[download]   0.0% of 504.09MiB at 397.98KiB/s ETA 21:38")
 	if newD.Eta != "21:38" {
-		t.Fatalf("bad short eta in dl\n%#v", newD) //nolint
+		t.Fatalf("bad short eta in dl\n%#v", &newD) //nolint
 	}
 
 	// added a new file, now we are tracking two
@@ -44,7 +47,7 @@ func TestUpdateMetadata(t *testing.T) {
 	// different download
 	newD.updateMetadata("[download]  99.3% of ~1.42GiB at 320.87KiB/s ETA 00:07 (frag 212/214)")
 	if newD.Eta != "00:07" {
-		t.Fatalf("bad short eta in dl with frag\n%v", newD) //nolint
+		t.Fatalf("bad short eta in dl with frag\n%v", &newD) //nolint
 	}
 
 	// [FixupM3u8] Fixing MPEG-TS in MP4 container of "file [-168849776_456239489].mp4"
@@ -360,3 +363,303 @@ Deleting original file The Greatest Shot In Television [2WoDQBhJCVQ].f140.m4a (p
 	}
 
 }
+
+func TestUpdateMetadataStructured(t *testing.T) {
+	newD := Download{}
+	tick := func(j string) {
+		newD.updateMetadata(progressPrefix + j)
+	}
+
+	// ordinary output is still matched against the patterns
+	newD.updateMetadata("[download] Destination: Video [abc].f137.mp4")
+	assert.Equal(t, []string{"Video [abc].f137.mp4"}, newD.Files)
+
+	tick(`{"status": "downloading", "filename": "Video [abc].f137.mp4", "tmpfilename": "Video [abc].f137.mp4.part", "downloaded_bytes": 1048576, "total_bytes": 4194304, "speed": 524288.5, "eta": 3725, "elapsed": 2.1, "_percent_str": " 25.0%"}`)
+	assert.Equal(t, []string{"Video [abc].f137.mp4"}, newD.Files, "already known")
+	assert.Equal(t, STATE_DOWNLOADING, newD.State)
+	assert.Equal(t, float32(25), newD.Percent)
+	assert.Equal(t, int64(1048576), newD.DownloadedBytes)
+	assert.Equal(t, int64(4194304), newD.TotalBytes)
+	assert.Equal(t, 524288.5, newD.Speed)
+	assert.Equal(t, "01:02:05", newD.Eta)
+
+	// fragmented, with only an estimated size and nothing else known
+	tick(`{"status": "downloading", "filename": "Video [abc].f137.mp4", "downloaded_bytes": 3000000, "total_bytes_estimate": 4000000.0, "speed": null, "eta": null, "fragment_index": 212, "fragment_count": 214}`)
+	assert.Equal(t, float32(75), newD.Percent)
+	assert.Equal(t, int64(4000000), newD.TotalBytes)
+	assert.Zero(t, newD.Speed)
+	assert.Equal(t, "", newD.Eta)
+	assert.Equal(t, 212, newD.FragmentIndex)
+	assert.Equal(t, 214, newD.FragmentCount)
+
+	// a new file is picked up from the progress
+	tick(`{"status": "finished", "filename": "Video [abc].f140.m4a", "downloaded_bytes": 1000, "total_bytes": 1000, "eta": 0}`)
+	assert.Equal(t, []string{"Video [abc].f137.mp4", "Video [abc].f140.m4a"}, newD.Files)
+	assert.Equal(t, float32(100), newD.Percent)
+	assert.Equal(t, "00:00", newD.Eta)
+
+	// not JSON after all, so it is ordinary output
+	tick(`{"status": "downl`)
+	assert.Equal(t, float32(100), newD.Percent)
+
+	newD.updateMetadata(`[Merger] Merging formats into "Video [abc].mp4"`)
+	newD.updateMetadata("[FixupM3u8] Fixing MPEG-TS in MP4 container of \"Video [abc].mp4\"")
+	assert.Equal(t, []string{"Video [abc].f137.mp4", "Video [abc].f140.m4a", "Video [abc].mp4"}, newD.Files)
+	assert.Equal(t, STATE_FIXING_MPEG_TS, newD.State)
+
+	// progress lines with long filenames are read whole
+	long := strings.Repeat("long ", 500) + ".mp4"
+	newD.updateDownload(strings.NewReader("[download] Destination: " + long + "\n" +
+		progressPrefix + `{"status": "downloading", "filename": "` + long + `", "downloaded_bytes": 5, "total_bytes": 10}` + "\n"))
+	assert.Equal(t, long, newD.Files[len(newD.Files)-1])
+	assert.Equal(t, float32(50), newD.Percent)
+	assert.Len(t, newD.Log, 2)
+}
+
+func TestTrackFiles(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.DownloadPath = t.TempDir()
+	final := filepath.Join(conf.Server.DownloadPath, "Video [abc].mp4")
+	assert.NoError(t, os.WriteFile(final, []byte("video"), 0644))
+	subs := filepath.Join(conf.Server.DownloadPath, "subs", "Video [abc].en.vtt")
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{Name: "tracked", Command: "yt-dlp", TrackFiles: true}
+	for _, l := range []string{
+		"[download] Destination: Video [abc].f137.mp4",
+		"[download] Destination: Video [abc].f140.m4a",
+		`[Merger] Merging formats into "Video [abc].mp4"`,
+		// renamed by a post-processor, and not reported in the usual output
+		filePrefix + "subs/Video [abc].en.vtt",
+		filePrefix + final,
+		filePrefix + "Video [abc].mp4",
+	} {
+		dl.updateMetadata(l)
+	}
+	// paths are made absolute, and not repeated
+	assert.Equal(t, []string{"Video [abc].f137.mp4", "Video [abc].f140.m4a", "Video [abc].mp4", subs, final}, dl.Files)
+
+	dl.State = STATE_DOWNLOADING
+	dl.complete()
+	assert.Equal(t, STATE_COMPLETE, dl.State)
+	assert.Equal(t, []string{subs, final}, dl.Files, "only the final paths are kept")
+	assert.Equal(t, []OutputFile{{Path: subs}, {Path: final, Size: 5, Exists: true}}, dl.OutputFiles)
+	assert.Equal(t, "file "+subs+" is missing", dl.Log[len(dl.Log)-1])
+
+	// without any final paths, the files from the usual output are kept
+	untracked := NewDownload("http://example.org/", conf)
+	untracked.DownloadProfile = dl.DownloadProfile
+	untracked.updateMetadata(`[Merger] Merging formats into "Video [abc].mp4"`)
+	untracked.State = STATE_DOWNLOADING
+	untracked.complete()
+	assert.Equal(t, []string{"Video [abc].mp4"}, untracked.Files)
+	assert.Equal(t, []OutputFile{{Path: "Video [abc].mp4", Size: 5, Exists: true}}, untracked.OutputFiles)
+}
+
+func TestOutputArgs(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{Name: "echo", Command: "/bin/echo", StructuredProgress: true, TrackFiles: true}
+	dl.State = STATE_PREPARING
+	dl.Begin()
+
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	assert.Equal(t, STATE_COMPLETE, dl.State)
+	assert.Contains(t, dl.Log, "--progress-template download:"+progressPrefix+"%(progress)j --no-quiet --print after_move:"+filePrefix+"%(filepath)s")
+}
+
+func TestCleanup(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Retention = config.Retention{
+		Completed: config.RetentionRule{MaxAge: "1h", MaxCount: 2},
+		Failed:    config.RetentionRule{KeepForever: true},
+		Stopped:   config.RetentionRule{MaxAge: "1h"},
+	}
+
+	clock := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	finishedDL := func(state State, ago time.Duration) *Download {
+		dl := NewDownload("http://example.org/", conf)
+		dl.State = state
+		dl.Finished = true
+		dl.FinishedTS = clock.Add(-ago)
+		return dl
+	}
+
+	oldComplete := finishedDL(STATE_COMPLETE, 2*time.Hour)
+	complete1 := finishedDL(STATE_COMPLETE, 3*time.Minute)
+	complete2 := finishedDL(STATE_COMPLETE, 2*time.Minute)
+	complete3 := finishedDL(STATE_COMPLETE, 1*time.Minute)
+	oldFailed := finishedDL(STATE_FAILED, 48*time.Hour)
+	oldStopped := finishedDL(STATE_STOPPED, 2*time.Hour)
+	queued := NewDownload("http://example.org/", conf)
+	queued.State = STATE_QUEUED
+
+	m := Manager{Config: conf, clock: func() time.Time { return clock }}
+	for _, dl := range []*Download{oldComplete, complete1, complete2, complete3, oldFailed, oldStopped, queued} {
+		m.AddDownload(dl)
+	}
+
+	m.Lock.Lock()
+	next := m.cleanup()
+	m.Lock.Unlock()
+
+	assert.Equal(t, []*Download{complete2, complete3, oldFailed, queued}, m.Downloads)
+	assert.Equal(t, complete2.FinishedTS.Add(time.Hour), next)
+
+	// removed once it is old enough, by the Manager's clock
+	clock = next.Add(time.Second)
+	m.Lock.Lock()
+	m.cleanup()
+	m.Lock.Unlock()
+
+	assert.Equal(t, []*Download{complete3, oldFailed, queued}, m.Downloads)
+
+	removed := m.ClearFinished()
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, []*Download{queued}, m.Downloads)
+}
+
+func TestPauseResume(t *testing.T) {
+	if !CanPauseDownload {
+		t.Skip("pausing not supported on this platform")
+	}
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = *conf.ProfileCalled("test profile")
+	q := Manager{}
+	q.AddDownload(dl)
+	q.Queue(dl)
+
+	assert.Error(t, dl.Pause(), "cannot pause before starting")
+
+	q.Lock.Lock()
+	q.startQueued(1)
+	q.Lock.Unlock()
+	time.Sleep(time.Millisecond * 100)
+
+	if assert.NoError(t, dl.Pause()) {
+		dl.Lock.Lock()
+		assert.Equal(t, STATE_PAUSED, dl.State)
+		assert.False(t, dl.isActive(), "paused downloads do not use a slot")
+		dl.Lock.Unlock()
+	}
+	assert.Error(t, dl.Pause(), "already paused")
+
+	if assert.NoError(t, dl.Resume()) {
+		dl.Lock.Lock()
+		assert.Equal(t, STATE_DOWNLOADING, dl.State)
+		dl.Lock.Unlock()
+	}
+	assert.Error(t, dl.Resume(), "not paused")
+
+	assert.NoError(t, dl.Stop())
+}
+
+func TestRetryAndClone(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := Manager{}
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = *conf.ProfileCalled("test profile")
+	m.AddDownload(dl)
+
+	assert.Error(t, dl.Retry(), "cannot retry before it has failed")
+
+	dl.Lock.Lock()
+	dl.State = STATE_FAILED
+	dl.Finished = true
+	dl.ExitCode = 1
+	dl.Percent = 50
+	dl.Files = []string{"partial.mp4"}
+	dl.Log = []string{"ERROR: something"}
+	dl.Lock.Unlock()
+
+	if assert.NoError(t, dl.Retry()) {
+		assert.Equal(t, STATE_QUEUED, dl.State)
+		assert.False(t, dl.Finished)
+		assert.Equal(t, 0, dl.ExitCode)
+		assert.Equal(t, float32(0), dl.Percent)
+		assert.Empty(t, dl.Files)
+		assert.Len(t, dl.Log, 2, "log is kept, with a separator")
+	}
+
+	option := &config.DownloadOption{Name: "elsewhere", Args: []string{"-o", "/elsewhere"}}
+	clone := m.Clone(dl, config.DownloadProfile{Name: "other", Command: "/bin/true"}, option)
+	assert.NotEqual(t, dl.Id, clone.Id)
+	assert.Equal(t, dl.Id, clone.ClonedFrom)
+	assert.Equal(t, dl.Url, clone.Url)
+	assert.Equal(t, "other", clone.DownloadProfile.Name)
+	assert.Equal(t, option, clone.DownloadOption)
+	assert.Equal(t, STATE_QUEUED, clone.State)
+	assert.Len(t, m.Downloads, 2)
+}
+
+func TestAutomaticRetry(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	clock := time.Now().Add(-time.Minute)
+	m := Manager{MaxPerDomain: 2, clock: func() time.Time { return clock }}
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{
+		Name:    "failing",
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo 'ERROR: unable to download video data: HTTP Error 503: Service Unavailable'; exit 1"},
+		Retry:   config.RetryPolicy{MaxAttempts: 2, Backoff: []string{"1h"}, Retryable: []string{"server-error"}},
+	}
+	m.AddDownload(dl)
+
+	// first attempt fails with a retryable error, so it is queued again
+	dl.Lock.Lock()
+	dl.State = STATE_PREPARING
+	dl.Files = []string{"earlier.mp4"}
+	dl.Lock.Unlock()
+	dl.Begin()
+
+	dl.Lock.Lock()
+	assert.Equal(t, STATE_QUEUED, dl.State)
+	assert.False(t, dl.Finished)
+	assert.Equal(t, 1, dl.Attempt)
+	if assert.NotNil(t, dl.FailureReason) {
+		assert.Equal(t, FAILURE_SERVER_ERROR, dl.FailureReason.Class)
+	}
+	assert.Equal(t, clock.Add(time.Hour), dl.NotBefore, "backoff follows the Manager's clock")
+	assert.Equal(t, []string{"earlier.mp4"}, dl.Files, "kept so its partial files can be cleaned up")
+	dl.Lock.Unlock()
+
+	// not started again until the backoff has passed
+	m.startQueued(2)
+	assert.Equal(t, STATE_QUEUED, dl.State)
+
+	// second attempt fails too, and there are no attempts left
+	dl.Lock.Lock()
+	dl.NotBefore = time.Time{}
+	dl.State = STATE_PREPARING
+	dl.Lock.Unlock()
+	dl.Begin()
+
+	dl.Lock.Lock()
+	assert.Equal(t, STATE_FAILED, dl.State)
+	assert.True(t, dl.Finished)
+	assert.Equal(t, 2, dl.Attempt)
+	dl.Lock.Unlock()
+
+	// a manual retry starts counting again
+	assert.NoError(t, dl.Retry())
+	assert.Equal(t, 0, dl.Attempt)
+	assert.Nil(t, dl.FailureReason)
+}
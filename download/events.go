@@ -0,0 +1,279 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of lifecycle event that happened to a Download.
+type EventType string
+
+const (
+	EVENT_QUEUED       EventType = "queued"
+	EVENT_STARTED      EventType = "started"
+	EVENT_PROGRESS     EventType = "progress"
+	EVENT_FILE_ADDED   EventType = "file-added"
+	EVENT_FILE_REMOVED EventType = "file-removed"
+	EVENT_COMPLETED    EventType = "completed"
+	EVENT_FAILED       EventType = "failed"
+	EVENT_STOPPED      EventType = "stopped"
+)
+
+// eventLogTail is the number of log lines included with events that finish
+// a download.
+const eventLogTail = 20
+
+// Event is sent on the EventBus whenever something happens to a Download.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Download Snapshot  `json:"download"`
+	File     string    `json:"file,omitempty"` // the file added or removed, for file events
+}
+
+// Snapshot is a copy of the details of a Download at the time of an Event, so
+// it can be used without holding the Download lock.
+type Snapshot struct {
+	Id          int          `json:"id"`
+	Url         string       `json:"url"`
+	Profile     string       `json:"profile"`
+	Option      string       `json:"option,omitempty"`
+	State       State        `json:"state"`
+	ExitCode    int          `json:"exit_code"`
+	Percent     float32      `json:"percent"`
+	Eta         string       `json:"eta"`
+	Files       []string     `json:"files"`
+	OutputFiles []OutputFile `json:"output_files,omitempty"` // the files, checked when the download completed, if the profile tracks files
+	LogTail     []string     `json:"log_tail,omitempty"`     // only included when the download finishes
+}
+
+// EventBus delivers Events to any number of subscribers. Each subscriber has
+// a bounded buffer, and delivery never blocks - events for a subscriber which
+// is not keeping up are dropped and counted.
+type EventBus struct {
+	lock sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives Events on C until it is closed.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	types   map[EventType]bool
+	dropped atomic.Int64
+	bus     *EventBus
+}
+
+// Subscribe returns a new Subscription with a buffer of the given size. If any
+// types are given, only events of those types are delivered. The Subscription
+// must be closed when no longer needed.
+func (b *EventBus) Subscribe(size int, types ...EventType) *Subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	c := make(chan Event, size)
+	sub := &Subscription{C: c, c: c, bus: b}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool)
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Publish sends the event to all interested subscribers, without blocking.
+func (b *EventBus) Publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events which could not be delivered because
+// the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes from the bus and closes C.
+func (s *Subscription) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// validTransitions lists the states each state may move to. Running and paused
+// downloads only go back to the queue to be retried automatically, see requeue.
+var validTransitions = map[State][]State{
+	STATE_CHOOSE_PROFILE:       {STATE_QUEUED},
+	STATE_QUEUED:               {STATE_PREPARING},
+	STATE_PREPARING:            {STATE_DOWNLOADING, STATE_FAILED},
+	STATE_DOWNLOADING:          {STATE_DOWNLOADING_METADATA, STATE_FIXING_MPEG_TS, STATE_PAUSED, STATE_COMPLETE, STATE_FAILED, STATE_TIMED_OUT, STATE_STOPPED},
+	STATE_DOWNLOADING_METADATA: {STATE_DOWNLOADING, STATE_FIXING_MPEG_TS, STATE_PAUSED, STATE_COMPLETE, STATE_FAILED, STATE_TIMED_OUT, STATE_STOPPED},
+	STATE_FIXING_MPEG_TS:       {STATE_DOWNLOADING, STATE_DOWNLOADING_METADATA, STATE_PAUSED, STATE_COMPLETE, STATE_FAILED, STATE_TIMED_OUT, STATE_STOPPED},
+	STATE_PAUSED:               {STATE_DOWNLOADING, STATE_DOWNLOADING_METADATA, STATE_FIXING_MPEG_TS, STATE_COMPLETE, STATE_FAILED, STATE_TIMED_OUT, STATE_STOPPED},
+	STATE_COMPLETE:             {STATE_MOVED},
+	STATE_FAILED:               {STATE_QUEUED},
+	STATE_TIMED_OUT:            {STATE_QUEUED},
+	STATE_STOPPED:              {STATE_QUEUED},
+	STATE_MOVED:                {},
+}
+
+// canTransition reports whether a Download may move from one state to another.
+// A Download with no state yet (not created with NewDownload) may move to any state.
+func canTransition(from, to State) bool {
+	if from == "" {
+		return true
+	}
+	for _, s := range validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setState moves the Download to a new state, publishing the appropriate event.
+// Setting the current state again does nothing. Download must be locked.
+func (dl *Download) setState(to State) error {
+	from := dl.State
+	if from == to {
+		return nil
+	}
+	if !canTransition(from, to) {
+		err := fmt.Errorf("invalid state change for id %d from '%s' to '%s'", dl.Id, from, to)
+		log.Print(err)
+		return err
+	}
+	dl.enterState(to)
+	return nil
+}
+
+// enterState moves the Download to a new state without checking the
+// transition is valid, publishing the appropriate event. Download must be
+// locked.
+func (dl *Download) enterState(to State) {
+	from := dl.State
+	dl.State = to
+
+	switch {
+	case to == STATE_QUEUED:
+		dl.publishEvent(EVENT_QUEUED, "")
+	case to == STATE_DOWNLOADING && from == STATE_PREPARING:
+		dl.publishEvent(EVENT_STARTED, "")
+	case to == STATE_COMPLETE:
+		dl.publishEvent(EVENT_COMPLETED, "")
+	case to == STATE_STOPPED:
+		dl.publishEvent(EVENT_STOPPED, "")
+	case to == STATE_FAILED, to == STATE_TIMED_OUT:
+		dl.publishEvent(EVENT_FAILED, "")
+	}
+
+	// any other change may free up a slot, need to be scheduled, or need
+	// watching for stalls
+	if to != STATE_PREPARING {
+		dl.wakeScheduler()
+	}
+}
+
+// requeue puts a running or paused Download back in the queue, after its
+// downloader has failed, so it can be retried automatically. Download must be
+// locked.
+func (dl *Download) requeue() error {
+	if !dl.isActive() && dl.State != STATE_PAUSED {
+		err := fmt.Errorf("cannot requeue id %d which is '%s'", dl.Id, dl.State)
+		log.Print(err)
+		return err
+	}
+	dl.enterState(STATE_QUEUED)
+	return nil
+}
+
+// finish marks the Download as finished, moving it to the final state given.
+// A finished download must be in a final state, so if the transition is not
+// valid it is logged and the state is forced. Download must be locked.
+func (dl *Download) finish(to State) {
+	if dl.State != to && !canTransition(dl.State, to) {
+		log.Printf("forcing invalid state change for id %d from '%s' to final state '%s'", dl.Id, dl.State, to)
+	}
+	// set before the state changes, so the event includes the log
+	dl.Finished = true
+	dl.FinishedTS = dl.now()
+	if dl.State != to {
+		dl.enterState(to)
+	}
+}
+
+// addFile records a new file for this Download, unless it already has it, as
+// when a retry downloads the same file again. Download must be locked.
+func (dl *Download) addFile(f string) {
+	if slices.Contains(dl.Files, f) {
+		return
+	}
+	dl.Files = append(dl.Files, f)
+	dl.publishEvent(EVENT_FILE_ADDED, f)
+}
+
+// removeFile removes a file from this Download, if it is present. Download must
+// be locked.
+func (dl *Download) removeFile(f string) {
+	for i := range dl.Files {
+		if dl.Files[i] == f {
+			dl.Files = append(dl.Files[:i], dl.Files[i+1:]...)
+			dl.publishEvent(EVENT_FILE_REMOVED, f)
+			return
+		}
+	}
+}
+
+// publishEvent sends an event about this Download to the bus, if it has one.
+// Download must be locked.
+func (dl *Download) publishEvent(t EventType, file string) {
+	if dl.bus == nil {
+		return
+	}
+	dl.bus.Publish(Event{Type: t, Time: time.Now(), Download: dl.snapshot(dl.Finished), File: file})
+}
+
+// snapshot returns a copy of the details of this Download, optionally including
+// the end of the log. Download must be locked.
+func (dl *Download) snapshot(withLog bool) Snapshot {
+	s := Snapshot{
+		Id:          dl.Id,
+		Url:         dl.Url,
+		Profile:     dl.DownloadProfile.Name,
+		State:       dl.State,
+		ExitCode:    dl.ExitCode,
+		Percent:     dl.Percent,
+		Eta:         dl.Eta,
+		Files:       append([]string{}, dl.Files...),
+		OutputFiles: dl.OutputFiles,
+	}
+	if dl.DownloadOption != nil {
+		s.Option = dl.DownloadOption.Name
+	}
+	if withLog {
+		start := max(len(dl.Log)-eventLogTail, 0)
+		s.LogTail = append([]string{}, dl.Log[start:]...)
+	}
+	return s
+}
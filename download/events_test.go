@@ -0,0 +1,145 @@
+package download
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestSetState(t *testing.T) {
+	bus := EventBus{}
+	sub := bus.Subscribe(10)
+	defer sub.Close()
+
+	dl := &Download{Id: 1, State: STATE_CHOOSE_PROFILE, bus: &bus}
+
+	assert.Error(t, dl.setState(STATE_DOWNLOADING), "cannot start before being queued")
+	assert.Equal(t, STATE_CHOOSE_PROFILE, dl.State)
+
+	assert.NoError(t, dl.setState(STATE_QUEUED))
+	assert.NoError(t, dl.setState(STATE_QUEUED), "same state is a no-op")
+	assert.NoError(t, dl.setState(STATE_PREPARING))
+	assert.NoError(t, dl.setState(STATE_DOWNLOADING))
+	assert.NoError(t, dl.setState(STATE_DOWNLOADING_METADATA))
+	assert.NoError(t, dl.setState(STATE_DOWNLOADING))
+	assert.Error(t, dl.setState(STATE_QUEUED), "only requeue puts a running download back in the queue")
+	dl.finish(STATE_COMPLETE)
+	assert.True(t, dl.Finished)
+	assert.Error(t, dl.setState(STATE_DOWNLOADING), "cannot restart a finished download")
+
+	types := []EventType{}
+	for len(sub.C) > 0 {
+		types = append(types, (<-sub.C).Type)
+	}
+	assert.Equal(t, []EventType{EVENT_QUEUED, EVENT_STARTED, EVENT_COMPLETED}, types)
+
+	// finishing from a state with no valid transition still ends in the final state
+	dl = &Download{Id: 2, State: STATE_QUEUED, bus: &bus}
+	dl.finish(STATE_STOPPED)
+	assert.Equal(t, STATE_STOPPED, dl.State)
+	assert.True(t, dl.Finished)
+	assert.Equal(t, EVENT_STOPPED, (<-sub.C).Type)
+}
+
+func TestEventBusFilterAndDrop(t *testing.T) {
+	bus := EventBus{}
+	all := bus.Subscribe(1)
+	defer all.Close()
+	failures := bus.Subscribe(5, EVENT_FAILED, EVENT_STOPPED)
+	defer failures.Close()
+
+	bus.Publish(Event{Type: EVENT_QUEUED})
+	bus.Publish(Event{Type: EVENT_FAILED})
+	bus.Publish(Event{Type: EVENT_PROGRESS})
+
+	assert.Equal(t, EVENT_QUEUED, (<-all.C).Type)
+	assert.Equal(t, int64(2), all.Dropped())
+
+	assert.Equal(t, EVENT_FAILED, (<-failures.C).Type)
+	assert.Len(t, failures.C, 0)
+	assert.Equal(t, int64(0), failures.Dropped())
+}
+
+func TestDownloadLifecycleEvents(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := Manager{}
+	sub := m.Events.Subscribe(20)
+	defer sub.Close()
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{Name: "echo", Command: "echo", Args: []string{"[download] Destination: file.mp4"}}
+	m.AddDownload(dl)
+	m.Queue(dl)
+
+	m.Lock.Lock()
+	m.startQueued(1)
+	m.Lock.Unlock()
+
+	types := []EventType{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-sub.C:
+			types = append(types, e.Type)
+			if e.Type == EVENT_COMPLETED {
+				assert.Equal(t, []string{"file.mp4"}, e.Download.Files)
+				assert.NotEmpty(t, e.Download.LogTail)
+				assert.Equal(t, []EventType{EVENT_QUEUED, EVENT_STARTED, EVENT_FILE_ADDED, EVENT_COMPLETED}, types)
+				return
+			}
+		case <-timeout:
+			t.Fatalf("download did not complete, events so far: %v", types)
+		}
+	}
+}
+
+func TestFailWhilePaused(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := Manager{}
+	sub := m.Events.Subscribe(10)
+	defer sub.Close()
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{
+		Name:  "failing",
+		Retry: config.RetryPolicy{MaxAttempts: 2, Backoff: []string{"1h"}, Retryable: []string{"server-error"}},
+	}
+	m.AddDownload(dl)
+
+	// the process exits with a retryable error while it is paused
+	dl.Lock.Lock()
+	dl.State = STATE_PAUSED
+	dl.pausedFrom = STATE_DOWNLOADING
+	dl.pausedByQueue = true
+	dl.Process = &os.Process{}
+	dl.Attempt = 1
+	dl.ExitCode = 1
+	dl.appendLog("ERROR: unable to download video data: HTTP Error 503: Service Unavailable")
+	dl.fail()
+	assert.Equal(t, STATE_QUEUED, dl.State, "queued again to retry")
+	assert.False(t, dl.Finished)
+	assert.Nil(t, dl.Process)
+	assert.False(t, dl.pausedByQueue)
+	dl.Lock.Unlock()
+	assert.Equal(t, EVENT_QUEUED, (<-sub.C).Type)
+
+	// it is killed by the watchdog while paused, with no attempts left
+	dl.Lock.Lock()
+	dl.State = STATE_PAUSED
+	dl.Attempt = 2
+	dl.timedOut = &FailureReason{Class: FAILURE_TIMED_OUT, Message: "took too long"}
+	dl.fail()
+	assert.Equal(t, STATE_TIMED_OUT, dl.State)
+	assert.True(t, dl.Finished)
+	dl.Lock.Unlock()
+	assert.Equal(t, EVENT_FAILED, (<-sub.C).Type)
+}
@@ -0,0 +1,65 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FailureClass is the kind of failure a download had, used to decide whether
+// it is worth retrying.
+type FailureClass string
+
+const (
+	FAILURE_RATE_LIMITED FailureClass = "rate-limited"
+	FAILURE_SERVER_ERROR FailureClass = "server-error"
+	FAILURE_NETWORK      FailureClass = "network"
+	FAILURE_EXTRACTION   FailureClass = "extraction"
+	FAILURE_UNAVAILABLE  FailureClass = "unavailable"
+	FAILURE_STALLED      FailureClass = "stalled"   // killed for making no progress, see the watchdog
+	FAILURE_TIMED_OUT    FailureClass = "timed-out" // killed for running longer than the profile allows
+	FAILURE_UNKNOWN      FailureClass = "unknown"
+)
+
+// FailureReason records why a download failed.
+type FailureReason struct {
+	Class   FailureClass `json:"class"`
+	Message string       `json:"message"`
+}
+
+// failurePatterns are checked in order against downloader error lines, the
+// first match determines the class.
+var failurePatterns = []struct {
+	re    *regexp.Regexp
+	class FailureClass
+}{
+	// ERROR: [youtube] abc: Unable to download webpage: HTTP Error 429: Too Many Requests
+	{regexp.MustCompile(`HTTP Error 429|Too Many Requests`), FAILURE_RATE_LIMITED},
+	// ERROR: unable to download video data: HTTP Error 503: Service Unavailable
+	{regexp.MustCompile(`HTTP Error 5\d\d`), FAILURE_SERVER_ERROR},
+	// ERROR: [generic] Unable to download webpage: <urlopen error [Errno -3] Temporary failure in name resolution>
+	{regexp.MustCompile(`(?i)connection reset|connection refused|connection aborted|timed out|name resolution|network is unreachable|IncompleteRead|Remote end closed connection`), FAILURE_NETWORK},
+	// ERROR: [vimeo] 12345: Video unavailable
+	{regexp.MustCompile(`(?i)video unavailable|private video|not available|has been removed|HTTP Error 404|HTTP Error 403`), FAILURE_UNAVAILABLE},
+	// ERROR: [site] abc: Unable to extract video url; please report this issue on ...
+	{regexp.MustCompile(`Unable to extract`), FAILURE_EXTRACTION},
+}
+
+// classifyFailure looks through the log for the last error reported by the
+// downloader, and determines what kind of failure it was.
+func classifyFailure(lines []string, exitCode int) *FailureReason {
+	for i := len(lines) - 1; i >= 0; i-- {
+		idx := strings.Index(lines[i], "ERROR:")
+		if idx < 0 {
+			continue
+		}
+		message := strings.TrimSpace(lines[i][idx+len("ERROR:"):])
+		for _, p := range failurePatterns {
+			if p.re.MatchString(message) {
+				return &FailureReason{Class: p.class, Message: message}
+			}
+		}
+		return &FailureReason{Class: FAILURE_UNKNOWN, Message: message}
+	}
+	return &FailureReason{Class: FAILURE_UNKNOWN, Message: fmt.Sprintf("downloader exited with code %d", exitCode)}
+}
@@ -0,0 +1,31 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		lines   []string
+		class   FailureClass
+		message string
+	}{
+		{[]string{"[youtube] abc: Downloading webpage", "ERROR: [youtube] abc: Unable to download webpage: HTTP Error 429: Too Many Requests"},
+			FAILURE_RATE_LIMITED, "[youtube] abc: Unable to download webpage: HTTP Error 429: Too Many Requests"},
+		{[]string{"ERROR: unable to download video data: HTTP Error 503: Service Unavailable"}, FAILURE_SERVER_ERROR, "unable to download video data: HTTP Error 503: Service Unavailable"},
+		{[]string{"ERROR: [generic] Unable to download webpage: [Errno 104] Connection reset by peer"}, FAILURE_NETWORK, "[generic] Unable to download webpage: [Errno 104] Connection reset by peer"},
+		{[]string{"ERROR: [site] abc: Unable to extract video url; please report this issue"}, FAILURE_EXTRACTION, "[site] abc: Unable to extract video url; please report this issue"},
+		{[]string{"ERROR: [vimeo] 12345: Video unavailable"}, FAILURE_UNAVAILABLE, "[vimeo] 12345: Video unavailable"},
+		{[]string{"ERROR: something odd happened"}, FAILURE_UNKNOWN, "something odd happened"},
+		{[]string{"no errors here"}, FAILURE_UNKNOWN, "downloader exited with code 2"},
+		// the last error wins
+		{[]string{"ERROR: HTTP Error 503", "retrying", "ERROR: Private video"}, FAILURE_UNAVAILABLE, "Private video"},
+	}
+	for _, test := range tests {
+		reason := classifyFailure(test.lines, 2)
+		assert.Equal(t, test.class, reason.Class, test.lines)
+		assert.Equal(t, test.message, reason.Message, test.lines)
+	}
+}
@@ -0,0 +1,81 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// filePrefix starts each line printed by the downloader with the final path
+// of a file, when the profile tracks files.
+const filePrefix = "[gropple-file] "
+
+// trackFilesArgs returns the arguments which make yt-dlp print the final path
+// of each file, once it has been moved into place. Printing makes yt-dlp
+// quiet by default, so that is turned off again to keep the usual output.
+func trackFilesArgs() []string {
+	return []string{"--no-quiet", "--print", "after_move:" + filePrefix + "%(filepath)s"}
+}
+
+// OutputFile is a file written by a download, checked when it completed.
+type OutputFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Exists bool   `json:"exists"`
+}
+
+// addFinalFile records the final path of a file printed by the downloader,
+// returning false if the line is not one. Download must be locked.
+func (dl *Download) addFinalFile(s string) bool {
+	f, ok := strings.CutPrefix(s, filePrefix)
+	if !ok || f == "" {
+		return false
+	}
+	path := dl.absolutePath(f)
+	if !slices.Contains(dl.finalFiles, path) {
+		dl.finalFiles = append(dl.finalFiles, path)
+	}
+	if !slices.Contains(dl.Files, path) {
+		dl.addFile(path)
+	}
+	return true
+}
+
+// complete finishes a download whose downloader succeeded. If the profile
+// tracks files, the files are replaced by the final paths printed by the
+// downloader, dropping any intermediate files seen in its output, and each
+// one is checked to record whether it exists and its size. Download must be
+// locked.
+func (dl *Download) complete() {
+	if !dl.DownloadProfile.TrackFiles {
+		dl.finish(STATE_COMPLETE)
+		return
+	}
+
+	if len(dl.finalFiles) == 0 {
+		dl.appendLog("the downloader did not print any final file paths, keeping the files seen in its output")
+	} else {
+		for _, f := range append([]string{}, dl.Files...) {
+			if !slices.Contains(dl.finalFiles, f) {
+				dl.removeFile(f)
+			}
+		}
+	}
+
+	dl.OutputFiles = make([]OutputFile, 0, len(dl.Files))
+	for _, f := range dl.Files {
+		of := OutputFile{Path: f}
+		fi, err := os.Stat(dl.absolutePath(f))
+		if err == nil {
+			of.Exists = true
+			of.Size = fi.Size()
+		} else {
+			log.Printf("file for id: %d is missing: %s", dl.Id, err)
+			dl.appendLog(fmt.Sprintf("file %s is missing", f))
+		}
+		dl.OutputFiles = append(dl.OutputFiles, of)
+	}
+	dl.finish(STATE_COMPLETE)
+}
@@ -0,0 +1,237 @@
+//go:build linux
+
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// cgroupRoots are where the cgroup v2 hierarchy may be mounted, the second
+// on systems which use v1 as well.
+var cgroupRoots = []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"}
+
+// cgroup2Magic identifies a cgroup v2 filesystem, from linux/magic.h
+const cgroup2Magic = 0x63677270
+
+// cpuPeriod is the period, in microseconds, over which CPU limits apply.
+const cpuPeriod = 100000
+
+// ioprio_set arguments, from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioLowestBE   = 7
+)
+
+// cgroupParent is the cgroup which the cgroups for downloads with memory or
+// CPU limits are created in. It is prepared when first needed.
+var cgroupParent struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// startLimited starts the command with the limits applied from the start, so
+// that any processes it starts straight away, like ffmpeg, are limited too.
+// Each limit which could not be applied is described in the problems
+// returned, and the command is started anyway. Unless the command could not be
+// started, release must be called once the process has exited.
+func startLimited(id int, cmd *exec.Cmd, limits config.ProcessLimits) (release func(), problems []string, err error) {
+	release = func() {}
+
+	if limits.MemoryMax != "" || limits.CPUMax != 0 {
+		path, dir, err := limitCgroup(id, limits)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("could not set the memory and CPU limits: %s", err))
+		} else {
+			// the process is created in the cgroup, rather than moved into it
+			defer dir.Close()
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+			release = func() { removeCgroup(path) }
+		}
+	}
+
+	if limits.Nice == 0 && limits.IOClass == config.IO_CLASS_DEFAULT {
+		err = cmd.Start()
+	} else {
+		var priorityProblems []string
+		priorityProblems, err = startWithPriority(cmd, limits)
+		problems = append(problems, priorityProblems...)
+	}
+	if err != nil {
+		release()
+		return func() {}, problems, err
+	}
+	return release, problems, nil
+}
+
+// startWithPriority starts the command from a thread which has been given the
+// niceness and IO class in the limits, so the process inherits them when it
+// is created. The thread cannot be given its old priority back without
+// privileges, so it is left locked to its goroutine when that exits, and the
+// runtime stops using it.
+func startWithPriority(cmd *exec.Cmd, limits config.ProcessLimits) (problems []string, err error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		tid := syscall.Gettid()
+
+		if limits.Nice != 0 {
+			err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, limits.Nice)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("could not set the niceness to %d: %s", limits.Nice, err))
+			}
+		}
+
+		if limits.IOClass != config.IO_CLASS_DEFAULT {
+			prio := ioprioClassBE<<ioprioClassShift | ioprioLowestBE
+			if limits.IOClass == config.IO_CLASS_IDLE {
+				prio = ioprioClassIdle << ioprioClassShift
+			}
+			_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+			if errno != 0 {
+				problems = append(problems, fmt.Sprintf("could not set the IO class to '%s': %s", limits.IOClass, errno))
+			}
+		}
+
+		err = cmd.Start()
+	}()
+	<-done
+	return problems, err
+}
+
+// limitCgroup creates a cgroup with the memory and CPU limits for a download.
+// It returns the path to the cgroup, and the cgroup directory opened so the
+// process can be created in it, which must be closed once it has been.
+func limitCgroup(id int, limits config.ProcessLimits) (string, *os.File, error) {
+	cgroupParent.once.Do(func() {
+		cgroupParent.path, cgroupParent.err = prepareCgroupParent()
+	})
+	if cgroupParent.err != nil {
+		return "", nil, cgroupParent.err
+	}
+
+	path := filepath.Join(cgroupParent.path, fmt.Sprintf("download-%d", id))
+	err := os.Mkdir(path, 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return "", nil, err
+	}
+
+	memory, err := limits.MemoryBytes()
+	if err == nil && memory > 0 {
+		err = os.WriteFile(filepath.Join(path, "memory.max"), []byte(strconv.FormatInt(memory, 10)), 0644)
+	}
+	if err == nil && limits.CPUMax > 0 {
+		quota := max(int(limits.CPUMax*cpuPeriod), 1000)
+		err = os.WriteFile(filepath.Join(path, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cpuPeriod)), 0644)
+	}
+	var dir *os.File
+	if err == nil {
+		dir, err = os.Open(path)
+	}
+	if err != nil {
+		removeCgroup(path)
+		return "", nil, err
+	}
+	return path, dir, nil
+}
+
+// PrepareLimits gets the cgroup for downloads with memory or CPU limits ready
+// at startup, if any profile in the config has them, so that any changes this
+// makes, see prepareCgroupParent, are logged straight away. Otherwise it is
+// done when first needed.
+func PrepareLimits(conf *config.Config) {
+	for _, p := range conf.DownloadProfiles {
+		if p.Limits.MemoryMax != "" || p.Limits.CPUMax != 0 {
+			cgroupParent.once.Do(func() {
+				cgroupParent.path, cgroupParent.err = prepareCgroupParent()
+			})
+			if cgroupParent.err != nil {
+				log.Printf("memory and CPU limits will not be applied: %s", cgroupParent.err)
+			}
+			return
+		}
+	}
+}
+
+// prepareCgroupParent enables the cpu and memory controllers for the children
+// of the cgroup gropple is running in, so downloads can be given cgroups of
+// their own there. If that cgroup has processes of its own, gropple moves
+// itself into a new child cgroup called "gropple" first, as the kernel
+// requires.
+func prepareCgroupParent() (string, error) {
+	root := ""
+	for _, r := range cgroupRoots {
+		var fs syscall.Statfs_t
+		if syscall.Statfs(r, &fs) == nil && fs.Type == cgroup2Magic {
+			root = r
+			break
+		}
+	}
+	if root == "" {
+		return "", errors.New("cgroup v2 is not mounted")
+	}
+
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	own := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		if rest, ok := strings.CutPrefix(line, "0::"); ok {
+			own = filepath.Join(root, rest)
+		}
+	}
+	if own == "" {
+		return "", errors.New("gropple is not in a cgroup v2 cgroup")
+	}
+
+	control := filepath.Join(own, "cgroup.subtree_control")
+	err = os.WriteFile(control, []byte("+cpu +memory"), 0644)
+	if errors.Is(err, syscall.EBUSY) {
+		// a cgroup which hands controllers on to its children cannot have
+		// processes of its own, so gropple moves into a child first
+		server := filepath.Join(own, "gropple")
+		log.Printf("moving gropple into the cgroup %s, so that downloads can have cgroups of their own", server)
+		err = os.Mkdir(server, 0755)
+		if err == nil || errors.Is(err, os.ErrExist) {
+			err = os.WriteFile(filepath.Join(server, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		}
+		if err == nil {
+			err = os.WriteFile(control, []byte("+cpu +memory"), 0644)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not enable the cpu and memory controllers in %s: %w", own, err)
+	}
+	log.Printf("downloads with memory or CPU limits will have cgroups in %s", own)
+	return own, nil
+}
+
+// removeCgroup removes a cgroup created for a download, once its processes
+// have exited.
+func removeCgroup(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		log.Printf("could not remove cgroup: %s", err)
+	}
+}
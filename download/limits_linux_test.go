@@ -0,0 +1,90 @@
+//go:build linux
+
+package download
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+// niceness returns the niceness of a process, or of a thread given as
+// "self/task/<tid>", from /proc.
+func niceness(t *testing.T, pid any) string {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	// the niceness is the 19th field, the fields after the command start at the 3rd
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return fields[16]
+}
+
+func TestStartLimited(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := &Manager{Config: conf}
+	dl := NewDownload("http://example.org/", conf)
+	// the child is started straight away, so only inherits limits which are
+	// in place when the downloader is created
+	dl.DownloadProfile = config.DownloadProfile{
+		Name: "limited", Command: "/bin/sh", Args: []string{"-c", "sleep 5 & wait"},
+		Limits: config.ProcessLimits{Nice: 10, IOClass: config.IO_CLASS_IDLE},
+	}
+	m.AddDownload(dl)
+	m.Queue(dl)
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	var pid int
+	assert.Eventually(t, func() bool {
+		dl.Lock.Lock()
+		defer dl.Lock.Unlock()
+		if dl.Process != nil && dl.State == STATE_DOWNLOADING {
+			pid = dl.Process.Pid
+			return true
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	var child int
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", pid, pid))
+		var err error
+		child, err = strconv.Atoi(strings.TrimSpace(string(b)))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	for _, p := range []int{pid, child} {
+		assert.Equal(t, "10", niceness(t, p))
+		prio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(p), 0)
+		if assert.Zero(t, errno) {
+			assert.Equal(t, uintptr(ioprioClassIdle), prio>>ioprioClassShift)
+		}
+	}
+
+	// only the thread which started the downloader has its priority lowered
+	runtime.LockOSThread()
+	assert.Equal(t, "0", niceness(t, fmt.Sprintf("self/task/%d", syscall.Gettid())))
+	runtime.UnlockOSThread()
+
+	dl.Lock.Lock()
+	for _, l := range dl.Log {
+		assert.NotContains(t, l, "could not", "all limits were applied")
+	}
+	dl.Lock.Unlock()
+
+	assert.NoError(t, dl.Stop())
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package download
+
+import (
+	"os/exec"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// startLimited starts the command. Limits are only supported on linux, so any
+// which are set are reported as problems. Unless the command could not be
+// started, release must be called once the process has exited.
+func startLimited(id int, cmd *exec.Cmd, limits config.ProcessLimits) (release func(), problems []string, err error) {
+	release = func() {}
+	if limits.IsSet() {
+		problems = append(problems, "process limits are only supported on linux, so none were applied")
+	}
+	return release, problems, cmd.Start()
+}
+
+// PrepareLimits does nothing, as limits are only supported on linux.
+func PrepareLimits(conf *config.Config) {}
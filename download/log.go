@@ -0,0 +1,234 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// LogDirPath returns the path to the directory where the full log of each
+// download is written, which lives in the same directory as the configuration
+// file.
+func LogDirPath(cs *config.ConfigService) string {
+	return filepath.Join(filepath.Dir(cs.ConfigPath), "logs")
+}
+
+// scanOutputLines is a bufio.SplitFunc for downloader output. Lines can end
+// with a newline, a carriage return followed by a newline, or a carriage
+// return on its own, which downloaders use to redraw their progress. The
+// line ending is kept, so the caller can tell which it was.
+func scanOutputLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	i := bytes.IndexAny(data, "\r\n")
+	if i < 0 {
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	if data[i] == '\r' {
+		if i+1 == len(data) && !atEOF {
+			// a newline may follow in the next read
+			return 0, nil, nil
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i+2], nil
+		}
+	}
+	return i + 1, data[:i+1], nil
+}
+
+// splitOutputLine returns the text of a line returned by scanOutputLines, and
+// whether it ended with a carriage return on its own.
+func splitOutputLine(token []byte) (string, bool) {
+	cr := bytes.HasSuffix(token, []byte("\r"))
+	return string(bytes.TrimRight(token, "\r\n")), cr
+}
+
+// appendLog adds lines to the log, writing them to the log file as well.
+// Download must be locked.
+func (dl *Download) appendLog(lines ...string) {
+	dl.Log = append(dl.Log, lines...)
+	dl.trimLog()
+	dl.writeLog(lines...)
+}
+
+// addOutput adds a line of downloader output to the log. A line which ended
+// with a carriage return is overwritten by the next line of the same output,
+// like on a terminal, so it is only kept in memory until then. Every line is
+// written to the log file, including those which were overwritten.
+// replace is the index in the full log of such a line from this output, or
+// -1. It returns the index of the line if it can be overwritten, or -1.
+// Download must be locked.
+func (dl *Download) addOutput(l string, replace int, cr bool) int {
+	if replace >= 0 && replace == dl.LogDropped+len(dl.Log)-1 {
+		dl.Log[len(dl.Log)-1] = l
+		// send it again, in place of the line it overwrote
+		dl.sentLog = min(dl.sentLog, replace)
+	} else {
+		dl.Log = append(dl.Log, l)
+		dl.trimLog()
+	}
+	dl.writeLog(l)
+	if cr {
+		return dl.LogDropped + len(dl.Log) - 1
+	}
+	return -1
+}
+
+// trimLog drops the oldest lines of the log kept in memory, once there are
+// more than the maximum in the config. Download must be locked.
+func (dl *Download) trimLog() {
+	if dl.Config == nil || dl.Config.Server.MaximumLogLines <= 0 {
+		return
+	}
+	drop := len(dl.Log) - dl.Config.Server.MaximumLogLines
+	if drop <= 0 {
+		return
+	}
+	// appending copies the remaining lines to a new array once this one is
+	// used up, so the dropped lines do not stay in memory
+	dl.Log = dl.Log[drop:]
+	dl.LogDropped += drop
+}
+
+// logPath returns the path to the log file, or "" if the Download does not
+// have one. Download must be locked.
+func (dl *Download) logPath() string {
+	if dl.logDir == "" {
+		return ""
+	}
+	return filepath.Join(dl.logDir, fmt.Sprintf("%d.log", dl.Id))
+}
+
+// writeLog appends lines to the log file, if the Download has one. While the
+// downloader is running the file is kept open, see openLog, otherwise it is
+// opened for each write. If it cannot be written, the log is only kept in
+// memory from then on. Download must be locked.
+func (dl *Download) writeLog(lines ...string) {
+	if dl.logPath() == "" || len(lines) == 0 {
+		return
+	}
+	f := dl.logFile
+	var err error
+	if f == nil {
+		f, err = dl.createLog()
+		if err == nil {
+			defer func() {
+				if err := f.Close(); err != nil {
+					log.Printf("could not close log file for id: %d: %s", dl.Id, err)
+				}
+			}()
+		}
+	}
+	if err == nil {
+		_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	if err != nil {
+		log.Printf("could not write log file for id: %d, it will only be kept in memory: %s", dl.Id, err)
+		dl.closeLog()
+		dl.logDir = ""
+	}
+}
+
+// createLog opens the log file for appending, creating it and the log
+// directory if needed. Download must be locked.
+func (dl *Download) createLog() (*os.File, error) {
+	err := os.MkdirAll(dl.logDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(dl.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// openLog opens the log file and keeps it open, so the output of the
+// downloader can be written to it without opening it for every line. It must
+// be closed with closeLog once the downloader has exited. Download must be
+// locked.
+func (dl *Download) openLog() {
+	if dl.logPath() == "" || dl.logFile != nil {
+		return
+	}
+	f, err := dl.createLog()
+	if err != nil {
+		log.Printf("could not open log file for id: %d, it will only be kept in memory: %s", dl.Id, err)
+		dl.logDir = ""
+		return
+	}
+	dl.logFile = f
+}
+
+// closeLog closes the log file, if it was opened with openLog. Download must
+// be locked.
+func (dl *Download) closeLog() {
+	if dl.logFile == nil {
+		return
+	}
+	err := dl.logFile.Close()
+	if err != nil {
+		log.Printf("could not close log file for id: %d: %s", dl.Id, err)
+	}
+	dl.logFile = nil
+}
+
+// startLog gives a new Download a log file in dir, replacing any left over
+// from a previous download with the same id, and writes the log so far to it.
+// Download must be locked.
+func (dl *Download) startLog(dir string) {
+	if dir == "" {
+		return
+	}
+	dl.logDir = dir
+	err := os.Remove(dl.logPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("could not remove old log file for id: %d: %s", dl.Id, err)
+	}
+	dl.writeLog(dl.Log...)
+}
+
+// removeLog removes the log file, once the Download has been removed from the
+// list. Download must be locked.
+func (dl *Download) removeLog() {
+	path := dl.logPath()
+	if path == "" {
+		return
+	}
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("could not remove log file for id: %d: %s", dl.Id, err)
+	}
+	dl.logDir = ""
+}
+
+// FullLog returns the full log of the Download. It is read from the log file,
+// or if there is none, it is the part of the log kept in memory.
+func (dl *Download) FullLog() (io.ReadCloser, error) {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+
+	path := dl.logPath()
+	if path != "" {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	b := bytes.Buffer{}
+	if dl.LogDropped > 0 {
+		fmt.Fprintf(&b, "(%d earlier lines are not available)\n", dl.LogDropped)
+	}
+	for _, l := range dl.Log {
+		b.WriteString(l + "\n")
+	}
+	return io.NopCloser(&b), nil
+}
@@ -0,0 +1,111 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestScanOutputLines(t *testing.T) {
+	output := "one\ntwo\r\n\r[download]   1.0%\r[download]  50.0%\r[download] 100.0%\r\nlast"
+	want := []string{"one\n", "two\r\n", "\r", "[download]   1.0%\r", "[download]  50.0%\r", "[download] 100.0%\r\n", "last"}
+
+	// lines must come out the same however the output is split up when read
+	for name, r := range map[string]io.Reader{
+		"all at once":      strings.NewReader(output),
+		"a byte at a time": iotest.OneByteReader(strings.NewReader(output)),
+	} {
+		scanner := bufio.NewScanner(r)
+		scanner.Split(scanOutputLines)
+		got := []string{}
+		for scanner.Scan() {
+			got = append(got, scanner.Text())
+		}
+		assert.NoError(t, scanner.Err())
+		assert.Equal(t, want, got, name)
+	}
+
+	l, cr := splitOutputLine([]byte("[download]  50.0%\r"))
+	assert.Equal(t, "[download]  50.0%", l)
+	assert.True(t, cr)
+	l, cr = splitOutputLine([]byte("two\r\n"))
+	assert.Equal(t, "two", l)
+	assert.False(t, cr)
+}
+
+func TestBoundedLog(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.MaximumLogLines = 3
+	dir := t.TempDir()
+
+	m := Manager{LogDir: dir}
+	sub := m.SubscribeChanges()
+	defer sub.Close()
+
+	dl := NewDownload("http://example.org/", conf)
+	dl.appendLog("before it was added")
+	m.AddDownload(dl)
+	c := <-sub.C
+	lines := c.Log
+
+	// as while the downloader is running, with the log file kept open
+	dl.Lock.Lock()
+	dl.openLog()
+	assert.NotNil(t, dl.logFile)
+	dl.Lock.Unlock()
+	dl.updateDownload(strings.NewReader("one\ntwo\n\rprogress 1%\rprogress 50%\rprogress 100%\nthree\n"))
+
+	dl.Lock.Lock()
+	dl.closeLog()
+	assert.Equal(t, []string{"two", "progress 100%", "three"}, dl.Log)
+	assert.Equal(t, 2, dl.LogDropped)
+	dl.Lock.Unlock()
+
+	// the feed carries the redrawn progress line in place of the one it overwrote
+	for len(sub.C) > 0 {
+		c = <-sub.C
+		if c.Log != nil {
+			lines = append(lines[:c.LogIndex], c.Log...)
+		}
+	}
+	assert.Equal(t, []string{"before it was added", "one", "two", "progress 100%", "three"}, lines)
+	assert.Equal(t, 2, c.LogDropped)
+
+	// the full log has everything, including the progress which was redrawn
+	path := filepath.Join(dir, fmt.Sprintf("%d.log", dl.Id))
+	b, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "before it was added\none\ntwo\nprogress 1%\nprogress 50%\nprogress 100%\nthree\n", string(b))
+	}
+	f, err := dl.FullLog()
+	if assert.NoError(t, err) {
+		full, _ := io.ReadAll(f)
+		f.Close()
+		assert.Equal(t, string(b), string(full))
+	}
+
+	dl.Lock.Lock()
+	dl.Finished = true
+	dl.Lock.Unlock()
+	assert.Equal(t, 1, m.ClearFinished())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "removed along with the download")
+
+	// without a log file, what is in memory is all there is
+	f, err = dl.FullLog()
+	if assert.NoError(t, err) {
+		full, _ := io.ReadAll(f)
+		f.Close()
+		assert.Equal(t, "(2 earlier lines are not available)\ntwo\nprogress 100%\nthree\n", string(full))
+	}
+}
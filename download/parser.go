@@ -0,0 +1,344 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// Parser understands the output of a kind of downloader.
+type Parser interface {
+	// Parse updates the Download from a line of output, and reports whether
+	// the line was a report of progress. Lines which are not understood are
+	// ignored, they are still added to the log. Download must be locked.
+	Parse(dl *Download, line string) (progress bool)
+}
+
+// parserFor returns the Parser for the profile, which is one of the PARSER
+// constants in the config. Unknown parsers get the yt-dlp parser. An error is
+// returned if the patterns for the custom parser are invalid, along with a
+// parser which understands nothing.
+func parserFor(profile config.DownloadProfile) (Parser, error) {
+	switch profile.Parser {
+	case config.PARSER_GALLERY_DL:
+		return galleryDLParser{}, nil
+	case config.PARSER_ARIA2C:
+		return aria2cParser{}, nil
+	case config.PARSER_WGET:
+		return wgetParser{}, nil
+	case config.PARSER_CUSTOM:
+		p := customParser{}
+		for _, pattern := range profile.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return customParser{}, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+			}
+			p.patterns = append(p.patterns, re)
+		}
+		return p, nil
+	}
+	return ytdlpParser{}, nil
+}
+
+// Patterns for the output of yt-dlp, and youtube-dl.
+var (
+	// [download]  49.7% of ~15.72MiB at  5.83MiB/s ETA 00:07
+	// [download]  99.3% of ~1.42GiB at 320.87KiB/s ETA 00:07 (frag 212/214)
+	// [download] 100% of   15.72MiB in 00:00:03 at 5.21MiB/s
+	etaRE      = regexp.MustCompile(`download.+ETA +(\d\d:\d\d(?::\d\d)?)`)
+	percentRE  = regexp.MustCompile(`download.+?([\d\.]+)%`)
+	sizeRE     = regexp.MustCompile(`download.+?% of +(~)? *([\d.]+)([KMGTPE]?i?B)\b`)
+	speedRE    = regexp.MustCompile(`download.+? at +([\d.]+)([KMGTPE]?i?B)/s`)
+	fragmentRE = regexp.MustCompile(`download.+\(frag (\d+)/(\d+)\)`)
+
+	// This appears once per destination file
+	// [download] Destination: Filename with spaces and other punctuation here be careful!.mp4
+	filenameRE = regexp.MustCompile(`download.+?Destination: (.+)$`)
+
+	// This means a file has been "created" by merging others
+	// [ffmpeg] Merging formats into "Toto - Africa (Official HD Video)-FTQbiNvZqaY.mp4"
+	mergedFilenameRE = regexp.MustCompile(`Merging formats into "(.+)"$`)
+
+	// This means a file has been deleted
+	// Gross - this time it's unquoted and has trailing guff
+	// Deleting original file Toto - Africa (Official HD Video)-FTQbiNvZqaY.f137.mp4 (pass -k to keep)
+	// This is very fragile
+	deletedFileRE = regexp.MustCompile(`Deleting original file (.+) \(pass -k to keep\)$`)
+
+	// [download] Downloading video 1 of 3
+	playlistDetailsRE = regexp.MustCompile(`Downloading video (\d+) of (\d+)`)
+
+	// [Site] user: Downloading JSON metadata page 2
+	metadataDLRE = regexp.MustCompile(`Downloading JSON metadata page (\d+)`)
+
+	// [FixupM3u8] Fixing MPEG-TS in MP4 container of "file [-168849776_456239489].mp4"
+	metadataFixupRE = regexp.MustCompile(`Fixing MPEG-TS in MP4 container`)
+)
+
+// ytdlpParser understands yt-dlp and youtube-dl. Lines printed by the
+// progress template, for structured progress, are parsed as JSON, final file
+// paths are recorded if the profile tracks files, and anything else is
+// matched against the patterns above.
+type ytdlpParser struct{}
+
+func (ytdlpParser) Parse(dl *Download, s string) bool {
+	if dl.updateProgress(s) {
+		return true
+	}
+	if dl.addFinalFile(s) {
+		return false
+	}
+
+	matches := etaRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.Eta = matches[1]
+		dl.setOutputState(STATE_DOWNLOADING)
+
+	}
+
+	progress := false
+	matches = percentRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		progress = true
+		p, err := strconv.ParseFloat(matches[1], 32)
+		if err == nil {
+			dl.Percent = float32(p)
+		}
+		dl.updateSizes(s)
+	}
+
+	matches = filenameRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.addFile(matches[1])
+	}
+
+	matches = mergedFilenameRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.addFile(matches[1])
+	}
+
+	matches = deletedFileRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.removeFile(matches[1])
+	}
+
+	matches = playlistDetailsRE.FindStringSubmatch(s)
+	if len(matches) == 3 {
+		total, _ := strconv.ParseInt(matches[2], 10, 32)
+		current, _ := strconv.ParseInt(matches[1], 10, 32)
+		dl.PlaylistTotal = int(total)
+		dl.PlaylistCurrent = int(current)
+	}
+
+	matches = metadataDLRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.setOutputState(STATE_DOWNLOADING_METADATA)
+	}
+
+	matches = metadataFixupRE.FindStringSubmatch(s)
+	if len(matches) == 1 {
+		dl.setOutputState(STATE_FIXING_MPEG_TS)
+	}
+
+	return progress
+}
+
+// updateSizes updates the sizes, speed and fragments of the Download from a
+// progress line printed by yt-dlp. Those which are not on the line, or are
+// "Unknown", are cleared. Download must be locked.
+func (dl *Download) updateSizes(s string) {
+	dl.TotalBytes, dl.DownloadedBytes, dl.TotalEstimated = 0, 0, false
+	matches := sizeRE.FindStringSubmatch(s)
+	if len(matches) == 4 {
+		total, ok := parseSize(matches[2], matches[3])
+		if ok {
+			dl.TotalBytes = total
+			dl.DownloadedBytes = int64(float64(total) * float64(dl.Percent) / 100)
+			dl.TotalEstimated = matches[1] == "~"
+		}
+	}
+
+	dl.Speed = 0
+	matches = speedRE.FindStringSubmatch(s)
+	if len(matches) == 3 {
+		speed, ok := parseSize(matches[1], matches[2])
+		if ok {
+			dl.Speed = float64(speed)
+		}
+	}
+
+	dl.FragmentIndex, dl.FragmentCount = 0, 0
+	matches = fragmentRE.FindStringSubmatch(s)
+	if len(matches) == 3 {
+		dl.FragmentIndex, _ = strconv.Atoi(matches[1])
+		dl.FragmentCount, _ = strconv.Atoi(matches[2])
+	}
+}
+
+// galleryDLParser understands gallery-dl, which prints the path of each file
+// once it has been downloaded, with "# " in front if it was already there. Its
+// other messages start with the extractor and level in brackets, like
+// "[twitter][info] ...". Anything else it or Python prints, like a traceback,
+// has no prefix, so a line is only taken as a file if it names one which
+// exists in the download path.
+type galleryDLParser struct{}
+
+func (galleryDLParser) Parse(dl *Download, s string) bool {
+	if strings.HasPrefix(s, "[") || strings.TrimSpace(s) == "" {
+		return false
+	}
+	f := strings.TrimPrefix(s, "# ")
+	path := dl.absolutePath(f)
+	if !dl.inDownloadPath(path) || !fileExists(path) {
+		return false
+	}
+	dl.addFile(f)
+	dl.setOutputState(STATE_DOWNLOADING)
+	return false
+}
+
+// Patterns for the output of aria2c.
+var (
+	// [#2089b0 400.0KiB/33.2MiB(1%) CN:1 DL:115.7KiB ETA:4m51s]
+	aria2cProgressRE = regexp.MustCompile(`^\[#\w+ .*\((\d+)%\)(?:.* ETA:(\w+))?.*\]$`)
+
+	// 05/13 10:31:24 [NOTICE] Download complete: /downloads/ubuntu.iso
+	aria2cCompleteRE = regexp.MustCompile(`Download complete: (.+)$`)
+)
+
+// aria2cParser understands aria2c, which prints a summary of the progress
+// regularly, and the path of each file once it is complete.
+type aria2cParser struct{}
+
+func (aria2cParser) Parse(dl *Download, s string) bool {
+	matches := aria2cCompleteRE.FindStringSubmatch(s)
+	if len(matches) == 2 {
+		dl.addFile(matches[1])
+	}
+
+	matches = aria2cProgressRE.FindStringSubmatch(s)
+	if len(matches) != 3 {
+		return false
+	}
+	p, err := strconv.ParseFloat(matches[1], 32)
+	if err == nil {
+		dl.Percent = float32(p)
+	}
+	dl.Eta = parseEta(matches[2])
+	dl.setOutputState(STATE_DOWNLOADING)
+	return true
+}
+
+// Patterns for the output of wget.
+var (
+	// Saving to: ‘ubuntu.iso’
+	wgetSavingRE = regexp.MustCompile(`^Saving to: [‘'"](.+)[’'"]$`)
+
+	// 2024-05-13 10:31:24 URL:https://example.org/ubuntu.iso [1024/1024] -> "ubuntu.iso" [1]
+	wgetSavedRE = regexp.MustCompile(`-> "(.+)" \[\d+\]$`)
+
+	//  51200K .......... .......... .......... .......... .......... 42%  105M 6s
+	// 102400K .......... ..........                                100% 98.2M=1.0s
+	wgetProgressRE = regexp.MustCompile(`^\s*\d+K[ .]+?(\d+)% +[\d.,]+[KMG]?(?: +(\S+)|=\S+)$`)
+)
+
+// wgetParser understands wget, with its default dot progress, or with
+// --no-verbose.
+type wgetParser struct{}
+
+func (wgetParser) Parse(dl *Download, s string) bool {
+	for _, re := range []*regexp.Regexp{wgetSavingRE, wgetSavedRE} {
+		matches := re.FindStringSubmatch(s)
+		if len(matches) == 2 {
+			dl.addFile(matches[1])
+		}
+	}
+
+	matches := wgetProgressRE.FindStringSubmatch(s)
+	if len(matches) != 3 {
+		return false
+	}
+	p, err := strconv.ParseFloat(matches[1], 32)
+	if err == nil {
+		dl.Percent = float32(p)
+	}
+	dl.Eta = parseEta(matches[2])
+	dl.setOutputState(STATE_DOWNLOADING)
+	return true
+}
+
+// customParser matches each line against the patterns from the profile, and
+// uses the named groups which matched to update the download. A line with a
+// percent or an ETA means the download is downloading, unless a state was
+// matched as well.
+type customParser struct {
+	patterns []*regexp.Regexp
+}
+
+func (p customParser) Parse(dl *Download, s string) bool {
+	progress := false
+	var state State
+	for _, re := range p.patterns {
+		matches := re.FindStringSubmatch(s)
+		if matches == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			value := strings.TrimSpace(matches[i])
+			if name == "" || value == "" {
+				continue
+			}
+			switch name {
+			case "percent":
+				p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 32)
+				if err == nil {
+					dl.Percent = float32(p)
+					progress = true
+				}
+			case "eta":
+				dl.Eta = parseEta(value)
+				progress = true
+			case "file":
+				dl.addFile(value)
+			case "playlist_current":
+				n, err := strconv.Atoi(value)
+				if err == nil {
+					dl.PlaylistCurrent = n
+				}
+			case "playlist_total":
+				n, err := strconv.Atoi(value)
+				if err == nil {
+					dl.PlaylistTotal = n
+				}
+			case "state":
+				for _, s := range []State{STATE_DOWNLOADING, STATE_DOWNLOADING_METADATA, STATE_FIXING_MPEG_TS} {
+					if strings.EqualFold(value, string(s)) {
+						state = s
+					}
+				}
+			}
+		}
+	}
+
+	if state == "" && progress {
+		state = STATE_DOWNLOADING
+	}
+	if state != "" {
+		dl.setOutputState(state)
+	}
+	return progress
+}
+
+// parseEta returns the time remaining in the same form as yt-dlp, if it is a
+// duration like "4m51s", and otherwise as it is.
+func parseEta(s string) string {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return s
+	}
+	return formatEta(d)
+}
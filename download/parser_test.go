@@ -0,0 +1,180 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestParserFor(t *testing.T) {
+	p, err := parserFor(config.DownloadProfile{})
+	assert.NoError(t, err)
+	assert.IsType(t, ytdlpParser{}, p)
+
+	p, err = parserFor(config.DownloadProfile{Parser: config.PARSER_WGET})
+	assert.NoError(t, err)
+	assert.IsType(t, wgetParser{}, p)
+
+	_, err = parserFor(config.DownloadProfile{Parser: config.PARSER_CUSTOM, Patterns: []string{`(?P<percent>\d+`}})
+	assert.Error(t, err)
+}
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile config.DownloadProfile
+		lines   []string
+		files   []string
+		percent float32
+		eta     string
+		state   State
+	}{
+		{
+			name:    "aria2c",
+			profile: config.DownloadProfile{Parser: config.PARSER_ARIA2C},
+			lines: []string{
+				"05/13 10:31:20 [NOTICE] Downloading 1 item(s)",
+				"[#2089b0 400.0KiB/33.2MiB(1%) CN:1 DL:115.7KiB ETA:4m51s]",
+				"[#2089b0 30.1MiB/33.2MiB(90%) CN:1 DL:2.1MiB ETA:1s]",
+				"05/13 10:31:24 [NOTICE] Download complete: /downloads/ubuntu.iso",
+			},
+			files:   []string{"/downloads/ubuntu.iso"},
+			percent: 90,
+			eta:     "00:01",
+			state:   STATE_DOWNLOADING,
+		},
+		{
+			name:    "wget",
+			profile: config.DownloadProfile{Parser: config.PARSER_WGET},
+			lines: []string{
+				"Length: 104857600 (100M) [application/octet-stream]",
+				"Saving to: ‘ubuntu.iso’",
+				" 51200K .......... .......... .......... .......... .......... 42%  105M 1m6s",
+				"102400K .......... ..........                                100% 98.2M=1.0s",
+			},
+			files:   []string{"ubuntu.iso"},
+			percent: 100,
+			eta:     "",
+			state:   STATE_DOWNLOADING,
+		},
+		{
+			name:    "wget without verbose output",
+			profile: config.DownloadProfile{Parser: config.PARSER_WGET},
+			lines: []string{
+				`2024-05-13 10:31:24 URL:https://example.org/ubuntu.iso [1024/1024] -> "ubuntu.iso" [1]`,
+			},
+			files: []string{"ubuntu.iso"},
+		},
+		{
+			name: "custom",
+			profile: config.DownloadProfile{Parser: config.PARSER_CUSTOM, Patterns: []string{
+				`^progress: (?P<percent>[\d.]+)% eta (?P<eta>\S+)$`,
+				`^saved (?P<file>.+)$`,
+				`^item (?P<playlist_current>\d+)/(?P<playlist_total>\d+)$`,
+				`^phase: (?P<state>.+)$`,
+			}},
+			lines: []string{
+				"starting up",
+				"item 2/5",
+				"progress: 12.5% eta 3m",
+				"saved a.bin",
+				"saved a.bin",
+				"phase: downloading metadata",
+				"phase: something unknown",
+			},
+			files:   []string{"a.bin"},
+			percent: 12.5,
+			eta:     "03:00",
+			state:   STATE_DOWNLOADING_METADATA,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := parserFor(test.profile)
+			assert.NoError(t, err)
+			dl := Download{parser: p}
+			for _, l := range test.lines {
+				dl.updateMetadata(l)
+			}
+			assert.Equal(t, test.files, dl.Files)
+			assert.Equal(t, test.percent, dl.Percent)
+			assert.Equal(t, test.eta, dl.Eta)
+			assert.Equal(t, test.state, dl.State)
+		})
+	}
+}
+
+func TestGalleryDLParser(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.DownloadPath = t.TempDir()
+
+	dir := filepath.Join(conf.Server.DownloadPath, "twitter", "user")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	for _, name := range []string{"1.jpg", "2.jpg"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{}, 0644))
+	}
+
+	p, err := parserFor(config.DownloadProfile{Parser: config.PARSER_GALLERY_DL})
+	assert.NoError(t, err)
+	dl := Download{parser: p, Config: conf}
+	for _, l := range []string{
+		"[twitter][info] Requesting guest token",
+		filepath.Join(dir, "1.jpg"),
+		"# twitter/user/2.jpg",
+		filepath.Join(dir, "1.jpg"),
+		"",
+		"Traceback (most recent call last):",
+		`  File "/usr/lib/python3/dist-packages/gallery_dl/job.py", line 151, in run`,
+		"KeyboardInterrupt",
+		"/usr/lib/python3/dist-packages/urllib3/connectionpool.py:1045: InsecureRequestWarning: Unverified HTTPS request",
+	} {
+		dl.updateMetadata(l)
+	}
+	assert.Equal(t, []string{filepath.Join(dir, "1.jpg"), "twitter/user/2.jpg"}, dl.Files, "only files in the download path are recorded")
+	assert.Equal(t, STATE_DOWNLOADING, dl.State)
+}
+
+func TestCustomParserPlaylist(t *testing.T) {
+	p, err := parserFor(config.DownloadProfile{Parser: config.PARSER_CUSTOM, Patterns: []string{
+		`^item (?P<playlist_current>\d+)/(?P<playlist_total>\d+)$`,
+	}})
+	assert.NoError(t, err)
+	dl := Download{parser: p}
+	dl.updateMetadata("item 2/5")
+	assert.Equal(t, 2, dl.PlaylistCurrent)
+	assert.Equal(t, 5, dl.PlaylistTotal)
+}
+
+func TestUpdateSizes(t *testing.T) {
+	dl := Download{}
+	dl.updateMetadata("[download]  49.7% of ~  15.72MiB at  5.83MiB/s ETA 00:07 (frag 12/40)")
+	assert.Equal(t, int64(16483614), dl.TotalBytes)
+	assert.True(t, dl.TotalEstimated)
+	assert.InDelta(t, 16483614*0.497, dl.DownloadedBytes, 1)
+	assert.Equal(t, float64(6113198), dl.Speed)
+	assert.Equal(t, 12, dl.FragmentIndex)
+	assert.Equal(t, 40, dl.FragmentCount)
+	assert.Len(t, dl.SpeedHistory, 1)
+
+	dl.updateMetadata("[download]  50.0% of 10.00KB at Unknown B/s ETA Unknown")
+	assert.Equal(t, int64(10000), dl.TotalBytes)
+	assert.False(t, dl.TotalEstimated)
+	assert.Equal(t, int64(5000), dl.DownloadedBytes)
+	assert.Zero(t, dl.Speed)
+	assert.Zero(t, dl.FragmentCount)
+
+	dl.updateMetadata("[download] 100% of    1.42GiB in 00:04:03 at 5.97MiB/s")
+	assert.Equal(t, int64(1524713390), dl.TotalBytes)
+	assert.Equal(t, dl.TotalBytes, dl.DownloadedBytes)
+	assert.InDelta(t, 5.97*1024*1024, dl.Speed, 1)
+
+	// not progress, so nothing changes
+	dl.updateMetadata("[download] Destination: 10.00MiB at 5.00MiB/s.mp4")
+	assert.Equal(t, int64(1524713390), dl.TotalBytes)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package download
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func init() {
+	CanPauseDownload = true
+}
+
+// setProcessGroup arranges for the command to be started in its own process
+// group, so that it and any processes it starts can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// suspendProcessGroup stops the process group led by p.
+func suspendProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGSTOP)
+}
+
+// resumeProcessGroup continues the process group led by p.
+func resumeProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGCONT)
+}
+
+// interruptProcessGroup interrupts the process group led by p, as if Ctrl-C
+// had been pressed. Stopped processes are continued, so they can handle the
+// signal.
+func interruptProcessGroup(p *os.Process) error {
+	err := syscall.Kill(-p.Pid, syscall.SIGINT)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-p.Pid, syscall.SIGCONT)
+}
+
+// terminateProcessGroup asks the process group led by p to exit. Stopped
+// processes are continued, so they can handle the signal.
+func terminateProcessGroup(p *os.Process) error {
+	err := syscall.Kill(-p.Pid, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-p.Pid, syscall.SIGCONT)
+}
+
+// killProcessGroup immediately kills the process group led by p.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package download
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing on windows.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// suspendProcessGroup is not supported on windows.
+func suspendProcessGroup(p *os.Process) error {
+	return errors.New("pausing downloads is not supported on windows")
+}
+
+// resumeProcessGroup is not supported on windows.
+func resumeProcessGroup(p *os.Process) error {
+	return errors.New("resuming downloads is not supported on windows")
+}
+
+// interruptProcessGroup kills the process, as windows has no way to interrupt
+// it.
+func interruptProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// terminateProcessGroup kills the process, as windows has no way to ask it
+// to exit.
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// killProcessGroup kills the process.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
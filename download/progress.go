@@ -0,0 +1,110 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// progressPrefix starts each line printed by the progress template, which is
+// given to the downloader when the profile uses structured progress.
+const progressPrefix = "[gropple-progress] "
+
+// progressTemplateArgs returns the arguments which make yt-dlp print its
+// progress as a line of JSON on each tick, for structured progress.
+func progressTemplateArgs() []string {
+	return []string{"--progress-template", "download:" + progressPrefix + "%(progress)j"}
+}
+
+// progressTick is the progress printed by the progress template. Fields which
+// yt-dlp does not know, like the total size of a live stream, are missing or
+// null.
+type progressTick struct {
+	Status             string   `json:"status"`
+	Filename           string   `json:"filename"`
+	DownloadedBytes    *float64 `json:"downloaded_bytes"`
+	TotalBytes         *float64 `json:"total_bytes"`
+	TotalBytesEstimate *float64 `json:"total_bytes_estimate"`
+	Speed              *float64 `json:"speed"`
+	Eta                *float64 `json:"eta"`
+	FragmentIndex      *int     `json:"fragment_index"`
+	FragmentCount      *int     `json:"fragment_count"`
+}
+
+// updateProgress updates the Download from a line printed by the progress
+// template. It returns false if the line is not one, so it can be parsed as
+// normal output instead. Download must be locked.
+func (dl *Download) updateProgress(s string) bool {
+	j, ok := strings.CutPrefix(s, progressPrefix)
+	if !ok {
+		return false
+	}
+	tick := progressTick{}
+	err := json.Unmarshal([]byte(j), &tick)
+	if err != nil {
+		log.Printf("could not parse progress for id: %d: %s", dl.Id, err)
+		return false
+	}
+
+	if tick.Filename != "" && !slices.Contains(dl.Files, tick.Filename) {
+		dl.addFile(tick.Filename)
+	}
+	if tick.Status == "downloading" {
+		dl.setOutputState(STATE_DOWNLOADING)
+	}
+
+	total := tick.TotalBytes
+	if total == nil {
+		total = tick.TotalBytesEstimate
+	}
+	dl.TotalBytes = 0
+	if total != nil {
+		dl.TotalBytes = int64(*total)
+	}
+	dl.TotalEstimated = tick.TotalBytes == nil && tick.TotalBytesEstimate != nil
+	downloaded := dl.DownloadedBytes
+	dl.DownloadedBytes = 0
+	if tick.DownloadedBytes != nil {
+		dl.DownloadedBytes = int64(*tick.DownloadedBytes)
+	}
+	dl.Speed = 0
+	if tick.Speed != nil {
+		dl.Speed = *tick.Speed
+	}
+	dl.Eta = ""
+	if tick.Eta != nil {
+		dl.Eta = formatEta(time.Duration(*tick.Eta) * time.Second)
+	}
+	dl.FragmentIndex, dl.FragmentCount = 0, 0
+	if tick.FragmentIndex != nil && tick.FragmentCount != nil {
+		dl.FragmentIndex, dl.FragmentCount = *tick.FragmentIndex, *tick.FragmentCount
+	}
+
+	// a downloader which is stuck may keep reporting the same amount
+	if dl.DownloadedBytes != downloaded {
+		dl.LastActivity = time.Now()
+	}
+	if tick.Status == "finished" {
+		dl.Percent = 100
+	} else if dl.TotalBytes > 0 {
+		dl.Percent = float32(math.Round(float64(dl.DownloadedBytes)/float64(dl.TotalBytes)*1000) / 10)
+	}
+	return true
+}
+
+// formatEta formats the time remaining in the same way as the downloader
+// output, like "04:15" or "01:02:03".
+func formatEta(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d/time.Minute) % 60
+	s := int(d/time.Second) % 60
+	if h > 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
@@ -0,0 +1,204 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// SetPriority changes the priority of the download. Queued downloads with a
+// higher priority are started first.
+func (dl *Download) SetPriority(priority int) {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	dl.Priority = priority
+	dl.publishChange()
+	dl.wakeScheduler()
+}
+
+// SetStartAfter sets the time before which the download will not be started.
+// A nil time means it may start as soon as possible.
+func (dl *Download) SetStartAfter(t *time.Time) {
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	dl.StartAfter = t
+	dl.publishChange()
+	dl.wakeScheduler()
+}
+
+// MoveToTop moves a queued download to the top of the list, so it is the next
+// to start. Its priority is raised to that of the highest priority queued
+// download, if needed.
+func (m *Manager) MoveToTop(dl *Download) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	others, err := m.queuedPriorities(dl)
+	if err != nil {
+		return err
+	}
+	priority := dl.Priority
+	if len(others) > 0 {
+		priority = max(priority, slices.Max(others))
+	}
+	m.moveTo(dl, 0, priority)
+	return nil
+}
+
+// MoveToBottom moves a queued download to the bottom of the list, so it is
+// the last to start. Its priority is lowered to that of the lowest priority
+// queued download, if needed.
+func (m *Manager) MoveToBottom(dl *Download) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	others, err := m.queuedPriorities(dl)
+	if err != nil {
+		return err
+	}
+	priority := dl.Priority
+	if len(others) > 0 {
+		priority = min(priority, slices.Min(others))
+	}
+	m.moveTo(dl, len(m.Downloads)-1, priority)
+	return nil
+}
+
+// MoveBefore moves a queued download so that it starts immediately before
+// another queued download. It takes on the priority of that download.
+func (m *Manager) MoveBefore(dl *Download, before *Download) error {
+	if dl == before {
+		return errors.New("cannot move a download before itself")
+	}
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	_, err := m.queuedPriorities(dl)
+	if err != nil {
+		return err
+	}
+	before.Lock.Lock()
+	priority := before.Priority
+	queued := before.State == STATE_QUEUED
+	before.Lock.Unlock()
+	if !queued {
+		return fmt.Errorf("cannot move a download before id %d, it is not queued", before.Id)
+	}
+
+	i := m.indexOf(before)
+	if m.indexOf(dl) < i {
+		// everything moves up once it is taken out
+		i--
+	}
+	m.moveTo(dl, i, priority)
+	return nil
+}
+
+// queuedPriorities checks the download can be moved, and returns the
+// priorities of all the other queued downloads. Expects the Manager to be
+// locked.
+func (m *Manager) queuedPriorities(dl *Download) ([]int, error) {
+	if m.indexOf(dl) < 0 {
+		return nil, fmt.Errorf("no download with id %d", dl.Id)
+	}
+
+	priorities := []int{}
+	for _, other := range m.Downloads {
+		other.Lock.Lock()
+		if other == dl && other.State != STATE_QUEUED {
+			state := other.State
+			other.Lock.Unlock()
+			return nil, fmt.Errorf("cannot move a download which is '%s'", state)
+		}
+		if other != dl && other.State == STATE_QUEUED {
+			priorities = append(priorities, other.Priority)
+		}
+		other.Lock.Unlock()
+	}
+	return priorities, nil
+}
+
+// indexOf returns the position of the download in the list, or -1 if it is
+// not there. Expects the Manager to be locked.
+func (m *Manager) indexOf(dl *Download) int {
+	return slices.Index(m.Downloads, dl)
+}
+
+// moveTo moves the download to position i in the list, and sets its priority.
+// Expects the Manager to be locked.
+func (m *Manager) moveTo(dl *Download, i int, priority int) {
+	m.Downloads = slices.Delete(m.Downloads, m.indexOf(dl), m.indexOf(dl)+1)
+	m.Downloads = slices.Insert(m.Downloads, i, dl)
+
+	dl.Lock.Lock()
+	dl.Priority = priority
+	dl.publishChange()
+	dl.Lock.Unlock()
+
+	m.publishOrder()
+	notify(m.wakeup())
+}
+
+// PauseQueue stops any more downloads from being started until the queue is
+// resumed. New downloads can still be added to the queue. If pauseRunning is
+// set, running downloads are paused as well.
+func (m *Manager) PauseQueue(pauseRunning bool) error {
+	if pauseRunning && !CanPauseDownload {
+		return errors.New("pausing downloads is not supported on this platform")
+	}
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.queuePaused = true
+	if pauseRunning {
+		for _, dl := range m.Downloads {
+			dl.Lock.Lock()
+			if dl.Process != nil && canTransition(dl.State, STATE_PAUSED) {
+				err := dl.pause("paused along with the queue")
+				if err != nil {
+					log.Printf("could not pause id %d with the queue: %s", dl.Id, err)
+				} else {
+					dl.pausedByQueue = true
+				}
+			}
+			dl.Lock.Unlock()
+		}
+	}
+	log.Print("queue paused")
+	m.publishQueueStatus()
+	notify(m.wakeup())
+	return nil
+}
+
+// ResumeQueue allows downloads to be started again, and resumes any which
+// were paused along with the queue.
+func (m *Manager) ResumeQueue() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.queuePaused = false
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if dl.pausedByQueue {
+			err := dl.resume("resumed along with the queue")
+			if err != nil {
+				log.Printf("could not resume id %d with the queue: %s", dl.Id, err)
+			}
+		}
+		dl.Lock.Unlock()
+	}
+	log.Print("queue resumed")
+	m.publishQueueStatus()
+	notify(m.wakeup())
+}
+
+// QueuePaused reports whether the queue is paused.
+func (m *Manager) QueuePaused() bool {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.queuePaused
+}
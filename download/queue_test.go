@@ -0,0 +1,269 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func queueTestManager(count int) (*Manager, []*Download) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := &Manager{MaxPerDomain: 1}
+	dls := []*Download{}
+	for i := 0; i < count; i++ {
+		dl := NewDownload("http://sub.example.org/", conf)
+		dl.DownloadProfile = *conf.ProfileCalled("test profile")
+		m.AddDownload(dl)
+		m.Queue(dl)
+		dls = append(dls, dl)
+	}
+	return m, dls
+}
+
+func ids(dls []*Download) []int {
+	out := []int{}
+	for _, dl := range dls {
+		out = append(out, dl.Id)
+	}
+	return out
+}
+
+func TestStartByPriority(t *testing.T) {
+	m, dls := queueTestManager(3)
+	dls[2].SetPriority(5)
+
+	m.Lock.Lock()
+	m.startQueued(1)
+	m.Lock.Unlock()
+
+	state := func(dl *Download) State {
+		dl.Lock.Lock()
+		defer dl.Lock.Unlock()
+		return dl.State
+	}
+	assert.Eventually(t, func() bool { return state(dls[2]) == STATE_DOWNLOADING }, time.Second, 10*time.Millisecond, "highest priority starts first")
+	assert.Equal(t, STATE_QUEUED, state(dls[0]))
+	assert.Equal(t, STATE_QUEUED, state(dls[1]))
+	assert.NoError(t, dls[2].Stop())
+}
+
+func TestMove(t *testing.T) {
+	m, dls := queueTestManager(4)
+	a, b, c, d := dls[0], dls[1], dls[2], dls[3]
+	b.SetPriority(3)
+
+	assert.NoError(t, m.MoveToTop(d))
+	assert.Equal(t, ids([]*Download{d, a, b, c}), ids(m.Downloads))
+	assert.Equal(t, 3, d.Priority, "raised to the highest queued priority")
+
+	assert.NoError(t, m.MoveToBottom(b))
+	assert.Equal(t, ids([]*Download{d, a, c, b}), ids(m.Downloads))
+	assert.Equal(t, 0, b.Priority, "lowered to the lowest queued priority")
+
+	assert.NoError(t, m.MoveBefore(c, a))
+	assert.Equal(t, ids([]*Download{d, c, a, b}), ids(m.Downloads))
+
+	assert.NoError(t, m.MoveBefore(d, b))
+	assert.Equal(t, ids([]*Download{c, a, d, b}), ids(m.Downloads))
+	assert.Equal(t, 0, d.Priority, "takes the priority of the one it is moved before")
+
+	assert.Error(t, m.MoveBefore(a, a))
+
+	a.Lock.Lock()
+	a.State = STATE_DOWNLOADING
+	a.Lock.Unlock()
+	assert.Error(t, m.MoveToTop(a), "only queued downloads can be moved")
+	assert.Error(t, m.MoveBefore(c, a), "only before queued downloads")
+}
+
+func TestQueueLimits(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	heavy := config.DownloadProfile{Name: "heavy", Command: "/bin/sleep", Args: []string{"5"}, MaximumActiveDownloads: 1}
+	light := *conf.ProfileCalled("test profile")
+
+	conf.Server.MaximumActiveDownloads = 2
+	conf.Server.MaximumActiveTotal = 4
+	m := &Manager{Config: conf}
+	add := func(url string, profile config.DownloadProfile) *Download {
+		dl := NewDownload(url, conf)
+		dl.DownloadProfile = profile
+		m.AddDownload(dl)
+		m.Queue(dl)
+		return dl
+	}
+	heavy1 := add("http://a.example.org/", heavy)
+	heavy2 := add("http://b.example.org/", heavy)
+	light1 := add("http://c.example.org/", light)
+	light2 := add("http://c.example.org/", light)
+	light3 := add("http://c.example.org/", light)
+	light4 := add("http://d.example.org/", light)
+	light5 := add("http://e.example.org/", light)
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	for _, dl := range []*Download{heavy1, light1, light2, light4} {
+		dl.Lock.Lock()
+		assert.True(t, dl.isActive(), dl.Url)
+		assert.Equal(t, WaitReason(""), dl.Waiting)
+		dl.Lock.Unlock()
+	}
+	assert.Equal(t, STATE_QUEUED, heavy2.State)
+	assert.Equal(t, WAIT_PROFILE_LIMIT, heavy2.Waiting)
+	assert.Equal(t, STATE_QUEUED, light3.State)
+	assert.Equal(t, WAIT_DOMAIN_LIMIT, light3.Waiting)
+	assert.Equal(t, STATE_QUEUED, light5.State)
+	assert.Equal(t, WAIT_GLOBAL_LIMIT, light5.Waiting)
+
+	// changes to the config apply straight away
+	conf.Server.MaximumActiveTotal = 5
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	light5.Lock.Lock()
+	assert.True(t, light5.isActive())
+	light5.Lock.Unlock()
+}
+
+func TestQueueDomainRules(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.DomainRules = []config.DomainRule{
+		{Name: "grouped", Hosts: []string{"a.example.org", "b.example.org"}},
+		{Name: "generous", Hosts: []string{"c.example.org"}, MaximumActiveDownloads: 2},
+		{Name: "slow", Hosts: []string{"d.example.org"}, MaximumActiveDownloads: 5, MinimumStartDelay: "1h"},
+	}
+
+	m := &Manager{MaxPerDomain: 1}
+	add := func(url string) *Download {
+		dl := NewDownload(url, conf)
+		dl.DownloadProfile = *conf.ProfileCalled("test profile")
+		m.AddDownload(dl)
+		m.Queue(dl)
+		return dl
+	}
+	a := add("http://a.example.org/")
+	b := add("http://www.b.example.org/")
+	c1 := add("http://c.example.org/1")
+	c2 := add("http://c.example.org/2")
+	c3 := add("http://c.example.org/3")
+	d1 := add("http://d.example.org/1")
+	d2 := add("http://d.example.org/2")
+
+	m.Lock.Lock()
+	m.startQueued(m.MaxPerDomain)
+	m.Lock.Unlock()
+
+	for _, dl := range []*Download{a, c1, c2, d1} {
+		dl.Lock.Lock()
+		assert.True(t, dl.isActive(), dl.Url)
+		dl.Lock.Unlock()
+	}
+	assert.Equal(t, WAIT_DOMAIN_LIMIT, b.Waiting, "hosts in a group share the limit")
+	assert.Equal(t, WAIT_DOMAIN_LIMIT, c3.Waiting, "group limit overrides the default")
+	assert.Equal(t, WAIT_START_DELAY, d2.Waiting)
+}
+
+func TestQueueSchedule(t *testing.T) {
+	m, dls := queueTestManager(3)
+	m.MaxPerDomain = 0
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	m.Config = cs.Config
+
+	later := time.Now().Add(time.Hour)
+	dls[0].SetStartAfter(&later)
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	dls[0].Lock.Lock()
+	assert.Equal(t, STATE_QUEUED, dls[0].State)
+	assert.Equal(t, WAIT_START_AFTER, dls[0].Waiting)
+	if assert.NotNil(t, dls[0].PlannedStart) {
+		assert.True(t, later.Equal(*dls[0].PlannedStart))
+	}
+	dls[0].Lock.Unlock()
+	for _, dl := range dls[1:] {
+		dl.Lock.Lock()
+		assert.True(t, dl.isActive())
+		assert.Nil(t, dl.PlannedStart)
+		dl.Lock.Unlock()
+	}
+
+	// only allow downloads in a window which starts in a couple of hours
+	start := time.Now().Add(2 * time.Hour)
+	m.Config.Schedule = config.Schedule{
+		Mode:    config.SCHEDULE_ONLY_DURING,
+		Windows: []config.TimeWindow{{Start: start.Format("15:04"), End: start.Add(time.Hour).Format("15:04")}},
+	}
+	dls[0].SetStartAfter(nil)
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	dls[0].Lock.Lock()
+	defer dls[0].Lock.Unlock()
+	assert.Equal(t, STATE_QUEUED, dls[0].State)
+	assert.Equal(t, WAIT_SCHEDULE, dls[0].Waiting)
+	if assert.NotNil(t, dls[0].PlannedStart) {
+		assert.Equal(t, start.Format("15:04"), dls[0].PlannedStart.Format("15:04"))
+	}
+}
+
+func TestQueuePause(t *testing.T) {
+	m, dls := queueTestManager(2)
+	m.MaxPerDomain = 0
+
+	m.Lock.Lock()
+	m.startQueued(1)
+	m.Lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, m.PauseQueue(CanPauseDownload))
+	assert.True(t, m.QueuePaused())
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	dls[1].Lock.Lock()
+	assert.Equal(t, STATE_QUEUED, dls[1].State)
+	assert.Equal(t, WAIT_QUEUE_PAUSED, dls[1].Waiting)
+	dls[1].Lock.Unlock()
+	if CanPauseDownload {
+		dls[0].Lock.Lock()
+		assert.Equal(t, STATE_PAUSED, dls[0].State, "running downloads are paused too")
+		dls[0].Lock.Unlock()
+	}
+
+	m.ResumeQueue()
+	assert.False(t, m.QueuePaused())
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+
+	for _, dl := range dls {
+		dl.Lock.Lock()
+		assert.True(t, dl.isActive(), "id %d should be running", dl.Id)
+		dl.Lock.Unlock()
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, dl := range dls {
+		assert.NoError(t, dl.Stop())
+	}
+}
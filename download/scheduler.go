@@ -0,0 +1,236 @@
+package download
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// persistDelay is how long to wait after a change before saving the
+// downloads, so that a burst of changes results in a single save.
+const persistDelay = time.Second
+
+// ManageQueue starts queued downloads, kills running downloads which have
+// stalled, and removes old finished ones. Rather than polling, it waits until
+// something happens which could allow a download to start - a download being
+// queued, paused or finishing, or the queue or config changing - or until the
+// next time at which a waiting download could start or a running download
+// could need killing. Changes to downloads are saved to the Store shortly
+// after they happen. It never returns.
+func (m *Manager) ManageQueue() {
+	changes := m.changes.Subscribe()
+	defer changes.Close()
+
+	m.Lock.Lock()
+	wake := m.wakeup()
+	m.Lock.Unlock()
+
+	// fires straight away, for the first look at the queue
+	timer := time.NewTimer(0)
+	var save <-chan time.Time
+
+	for {
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-changes.C:
+			// save soon, picking up any other changes in the meantime
+			if save == nil {
+				save = time.After(persistDelay)
+			}
+			continue
+		case <-save:
+			m.Lock.Lock()
+			m.persist()
+			m.Lock.Unlock()
+			save = nil
+			continue
+		}
+
+		m.Lock.Lock()
+		next := soonest(m.startQueued(m.MaxPerDomain), m.cleanup())
+		next = soonest(next, m.watchdog())
+		m.Lock.Unlock()
+
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// wakeup returns the channel used to wake the scheduler, creating it if
+// needed. Expects the Manager to be locked.
+func (m *Manager) wakeup() chan struct{} {
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+	}
+	return m.wake
+}
+
+// Wake asks the Manager to look at the queue again, for instance because the
+// config has changed.
+func (m *Manager) Wake() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	notify(m.wakeup())
+}
+
+// wakeScheduler asks the Manager to look at the queue again, if the download
+// has been added to one. Download must be locked.
+func (dl *Download) wakeScheduler() {
+	notify(dl.wake)
+}
+
+// notify sends on the channel without blocking. The channel has room for a
+// single value, so any number of notifications before the receiver gets to
+// them result in one wakeup.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// now returns the current time, according to the clock if one has been set.
+func (m *Manager) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return time.Now()
+}
+
+// now returns the current time, from the clock of the Manager the Download
+// was added to, if any.
+func (dl *Download) now() time.Time {
+	if dl.clock != nil {
+		return dl.clock()
+	}
+	return time.Now()
+}
+
+// soonest returns the earlier of the two times, ignoring zero times.
+func soonest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// candidate is what a queuePolicy knows about a queued download.
+type candidate struct {
+	id             int
+	group          string // the domain group of the download
+	batch          int    // the batch the download was submitted in
+	priority       int
+	lastStart      time.Time // when a download in the same group was last started
+	batchLastStart time.Time // when a download in the same batch was last started
+}
+
+// queuePolicy decides the order in which queued downloads are considered for
+// starting. A download is only started if the limits allow it, so one further
+// down the order may start before one which is waiting on a limit.
+type queuePolicy interface {
+	// order is given the candidates in list order, and returns them in the
+	// order they should be started.
+	order(queued []candidate) []candidate
+}
+
+// policyFor returns the queuePolicy with the name given, which is one of the
+// QUEUE_POLICY constants in the config. Unknown names get the priority policy.
+func policyFor(name string) queuePolicy {
+	switch name {
+	case config.QUEUE_POLICY_FIFO:
+		return fifoPolicy{}
+	case config.QUEUE_POLICY_ROUND_ROBIN:
+		return roundRobinPolicy{}
+	case config.QUEUE_POLICY_FAIR:
+		return fairPolicy{}
+	}
+	return priorityPolicy{}
+}
+
+// fifoPolicy starts downloads in list order, which is the order they were
+// added unless they have been moved.
+type fifoPolicy struct{}
+
+func (fifoPolicy) order(queued []candidate) []candidate {
+	return queued
+}
+
+// priorityPolicy starts the highest priority downloads first, and those with
+// the same priority in list order.
+type priorityPolicy struct{}
+
+func (priorityPolicy) order(queued []candidate) []candidate {
+	out := append([]candidate{}, queued...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].priority > out[j].priority
+	})
+	return out
+}
+
+// roundRobinPolicy takes turns between domain groups, starting with the group
+// which has gone longest without starting a download, so that a long queue
+// for one domain does not hold up the others. Within each group, the priority
+// policy applies.
+type roundRobinPolicy struct{}
+
+func (roundRobinPolicy) order(queued []candidate) []candidate {
+	groups := []string{}
+	byGroup := make(map[string][]candidate)
+	for _, c := range (priorityPolicy{}).order(queued) {
+		if _, ok := byGroup[c.group]; !ok {
+			groups = append(groups, c.group)
+		}
+		byGroup[c.group] = append(byGroup[c.group], c)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return byGroup[groups[i]][0].lastStart.Before(byGroup[groups[j]][0].lastStart)
+	})
+
+	out := make([]candidate, 0, len(queued))
+	for turn := 0; len(out) < len(queued); turn++ {
+		for _, g := range groups {
+			if turn < len(byGroup[g]) {
+				out = append(out, byGroup[g][turn])
+			}
+		}
+	}
+	return out
+}
+
+// fairPolicy takes turns between the batches downloads were submitted in,
+// starting with the batch which has gone longest without starting a download,
+// and within each batch the round robin policy applies. So a large bulk
+// submission does not hold up downloads added after it, and every domain in a
+// batch gets a turn.
+type fairPolicy struct{}
+
+func (fairPolicy) order(queued []candidate) []candidate {
+	batches := []int{}
+	byBatch := make(map[int][]candidate)
+	for _, c := range queued {
+		if _, ok := byBatch[c.batch]; !ok {
+			batches = append(batches, c.batch)
+		}
+		byBatch[c.batch] = append(byBatch[c.batch], c)
+	}
+	sort.SliceStable(batches, func(i, j int) bool {
+		return byBatch[batches[i]][0].batchLastStart.Before(byBatch[batches[j]][0].batchLastStart)
+	})
+	for _, b := range batches {
+		byBatch[b] = roundRobinPolicy{}.order(byBatch[b])
+	}
+
+	out := make([]candidate, 0, len(queued))
+	for turn := 0; len(out) < len(queued); turn++ {
+		for _, b := range batches {
+			if turn < len(byBatch[b]) {
+				out = append(out, byBatch[b][turn])
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+package download
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func candidateIds(cs []candidate) []int {
+	out := []int{}
+	for _, c := range cs {
+		out = append(out, c.id)
+	}
+	return out
+}
+
+func TestQueuePolicies(t *testing.T) {
+	earlier := time.Now().Add(-time.Hour)
+	later := time.Now()
+	queued := []candidate{
+		{id: 1, group: "a", lastStart: later},
+		{id: 2, group: "a", lastStart: later},
+		{id: 3, group: "a", priority: 5, lastStart: later},
+		{id: 4, group: "b", lastStart: earlier},
+		{id: 5, group: "b", lastStart: earlier},
+		{id: 6, group: "c"},
+	}
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, candidateIds(policyFor("fifo").order(queued)))
+	assert.Equal(t, []int{3, 1, 2, 4, 5, 6}, candidateIds(policyFor("priority").order(queued)))
+	assert.Equal(t, []int{3, 1, 2, 4, 5, 6}, candidateIds(policyFor("").order(queued)), "priority is the default")
+	// c has never started, b started before a, and a has its highest priority first
+	assert.Equal(t, []int{6, 4, 3, 5, 1, 2}, candidateIds(policyFor("round_robin").order(queued)))
+}
+
+// noopProfile is a profile whose downloads finish as soon as they start.
+var noopProfile = config.DownloadProfile{Name: "noop", Command: "/bin/true"}
+
+func TestManageQueue(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	var clockLock sync.Mutex
+	clock := time.Now()
+	m := &Manager{Config: conf, clock: func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return clock
+	}}
+	t.Cleanup(func() { m.Shutdown(time.Second) })
+	go m.ManageQueue()
+
+	started := func(dl *Download) func() bool {
+		return func() bool {
+			dl.Lock.Lock()
+			defer dl.Lock.Unlock()
+			return dl.State != STATE_QUEUED
+		}
+	}
+
+	// starts as soon as it is queued, without waiting for a poll
+	now := NewDownload("http://example.org/now", conf)
+	now.DownloadProfile = noopProfile
+	m.AddDownload(now)
+	m.Queue(now)
+	assert.Eventually(t, started(now), time.Second, 10*time.Millisecond)
+
+	// starts when its start time arrives
+	later := NewDownload("http://example.org/later", conf)
+	later.DownloadProfile = noopProfile
+	startAfter := clock.Add(time.Hour)
+	later.StartAfter = &startAfter
+	m.AddDownload(later)
+	m.Queue(later)
+	assert.Eventually(t, func() bool {
+		later.Lock.Lock()
+		defer later.Lock.Unlock()
+		return later.Waiting == WAIT_START_AFTER
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, started(later)(), "should not start before its start time")
+
+	clockLock.Lock()
+	clock = startAfter
+	clockLock.Unlock()
+	m.Wake()
+	assert.Eventually(t, started(later), time.Second, 10*time.Millisecond)
+}
+
+func TestFairPolicy(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.QueuePolicy = config.QUEUE_POLICY_FAIR
+	conf.Server.MaximumActiveDownloads = 0
+	conf.Server.MaximumActiveTotal = 1
+
+	clock := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	m := &Manager{Config: conf, clock: func() time.Time { return clock }}
+	t.Cleanup(func() { m.Shutdown(time.Second) })
+	add := func(url string, batch int) *Download {
+		dl := NewDownload(url, conf)
+		dl.DownloadProfile = noopProfile
+		if batch > 0 {
+			dl.Batch = batch
+		}
+		m.AddDownload(dl)
+		m.Queue(dl)
+		return dl
+	}
+
+	// a bulk submission mostly from one site, followed by two single downloads
+	x0 := add("http://x.example.org/0", 0)
+	x1 := add("http://x.example.org/1", x0.Batch)
+	x2 := add("http://x.example.org/2", x0.Batch)
+	y0 := add("http://y.example.org/0", x0.Batch)
+	x3 := add("http://x.example.org/3", x0.Batch)
+	z := add("http://z.example.org/", 0)
+	w := add("http://w.example.org/", 0)
+
+	// start one download at a time, a minute apart, once the last has finished
+	order := []*Download{}
+	for i := 1; i <= 7; i++ {
+		clock = clock.Add(time.Minute)
+		m.Lock.Lock()
+		m.startQueued(0)
+		m.Lock.Unlock()
+
+		for _, dl := range m.Downloads {
+			dl.Lock.Lock()
+			if dl.State != STATE_QUEUED && !slices.Contains(order, dl) {
+				order = append(order, dl)
+			}
+			dl.Lock.Unlock()
+		}
+		if !assert.Len(t, order, i) {
+			break
+		}
+		last := order[i-1]
+		assert.Eventually(t, func() bool {
+			last.Lock.Lock()
+			defer last.Lock.Unlock()
+			return last.Finished
+		}, time.Second, 10*time.Millisecond)
+	}
+	// single downloads do not wait for the bulk submission, and the other
+	// site in it gets a turn
+	assert.Equal(t, ids([]*Download{x0, z, w, y0, x1, x2, x3}), ids(order))
+}
@@ -0,0 +1,87 @@
+package download
+
+import (
+	"log"
+	"time"
+)
+
+// killWait is how long to wait for downloads to exit after they have been
+// killed.
+const killWait = 5 * time.Second
+
+// Shutdown stops any more downloads from starting, and asks the running ones
+// to exit, killing any which are still running after the grace period. The
+// interrupted downloads are saved as unfinished, so they are queued again
+// when the Manager is next restored.
+func (m *Manager) Shutdown(grace time.Duration) {
+	m.Lock.Lock()
+	m.shuttingDown = true
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if dl.isActive() || dl.State == STATE_PAUSED {
+			dl.interrupt()
+		}
+		dl.Lock.Unlock()
+	}
+	m.Lock.Unlock()
+
+	if !m.waitRunning(grace) {
+		log.Printf("downloads still running after %s, killing them", grace)
+		m.Kill()
+		if !m.waitRunning(killWait) {
+			log.Print("downloads still running after being killed, giving up on them")
+		}
+	}
+
+	m.Lock.Lock()
+	m.persist()
+	m.Lock.Unlock()
+}
+
+// Kill immediately kills the processes of all running downloads.
+func (m *Manager) Kill() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if dl.Process != nil && !dl.Finished {
+			dl.interrupted = true
+			err := killProcessGroup(dl.Process)
+			if err != nil {
+				log.Printf("could not kill process for id: %d: %s", dl.Id, err)
+			}
+		}
+		dl.Lock.Unlock()
+	}
+}
+
+// waitRunning waits for all started downloads to return, for up to the time
+// given. It reports whether they all returned.
+func (m *Manager) waitRunning(d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// interrupt asks the download process to exit, because we are shutting down.
+// Downloads which have not started their process yet will not start it.
+// Download must be locked.
+func (dl *Download) interrupt() {
+	dl.interrupted = true
+	if dl.Process == nil {
+		return
+	}
+	log.Printf("asking download id: %d to stop for shutdown", dl.Id)
+	err := terminateProcessGroup(dl.Process)
+	if err != nil {
+		log.Printf("could not terminate process for id: %d: %s", dl.Id, err)
+	}
+}
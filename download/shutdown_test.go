@@ -0,0 +1,79 @@
+//go:build !windows
+
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func shutdownTestManager(t *testing.T, script string) (*Manager, *Download) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	m := &Manager{MaxPerDomain: 2}
+	dl := NewDownload("http://example.org/", conf)
+	dl.DownloadProfile = config.DownloadProfile{Name: "slow", Command: "/bin/sh", Args: []string{"-c", script}}
+	m.AddDownload(dl)
+	dl.Lock.Lock()
+	_ = dl.setState(STATE_QUEUED)
+	dl.Lock.Unlock()
+
+	m.Lock.Lock()
+	m.startQueued(2)
+	m.Lock.Unlock()
+
+	// wait for the process to start
+	for i := 0; i < 100; i++ {
+		dl.Lock.Lock()
+		started := dl.Process != nil
+		dl.Lock.Unlock()
+		if started {
+			return m, dl
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("download did not start")
+	return nil, nil
+}
+
+func TestShutdown(t *testing.T) {
+	m, dl := shutdownTestManager(t, "sleep 30")
+
+	start := time.Now()
+	m.Shutdown(5 * time.Second)
+	assert.Less(t, time.Since(start), 5*time.Second, "exits when asked")
+
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	assert.False(t, dl.Finished, "interrupted downloads are not finished")
+	assert.Equal(t, STATE_DOWNLOADING, dl.State)
+	assert.Equal(t, "interrupted by shutdown", dl.Log[len(dl.Log)-1])
+
+	// nothing else starts
+	queued := NewDownload("http://example.org/", dl.Config)
+	queued.DownloadProfile = dl.DownloadProfile
+	m.AddDownload(queued)
+	m.Queue(queued)
+	m.Lock.Lock()
+	m.startQueued(2)
+	m.Lock.Unlock()
+	assert.Equal(t, STATE_QUEUED, queued.State)
+}
+
+func TestShutdownKillsAfterGrace(t *testing.T) {
+	m, dl := shutdownTestManager(t, `trap "" TERM; sleep 30`)
+
+	start := time.Now()
+	m.Shutdown(200 * time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second, "killed after the grace period")
+
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	assert.False(t, dl.Finished)
+	assert.Equal(t, "interrupted by shutdown", dl.Log[len(dl.Log)-1])
+}
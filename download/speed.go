@@ -0,0 +1,113 @@
+package download
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSpeedSamples is the most samples kept in the speed history of a
+// download. Once there are more, pairs of samples are merged, so the history
+// always covers the whole attempt.
+const maxSpeedSamples = 60
+
+// speedSampleLength is the time covered by each sample in the speed history,
+// until samples have to be merged.
+const speedSampleLength = 5 * time.Second
+
+// SpeedSample is the average speed of a download over a period of time, and
+// its progress at the end of it.
+type SpeedSample struct {
+	Time    time.Time `json:"time"`    // the start of the period
+	Speed   float64   `json:"speed"`   // bytes per second
+	Percent float32   `json:"percent"` // progress at the end of the period
+}
+
+// recordSpeed adds the current speed and progress to the speed history, at
+// time now. Readings are averaged into samples, each covering the same length
+// of time, which doubles each time the history gets too long. Download must be
+// locked.
+func (dl *Download) recordSpeed(now time.Time) {
+	if dl.sampleLength == 0 {
+		dl.sampleLength = speedSampleLength
+	}
+
+	n := len(dl.SpeedHistory)
+	if n > 0 && now.Sub(dl.SpeedHistory[n-1].Time) < dl.sampleLength {
+		dl.sampleCount++
+		last := &dl.SpeedHistory[n-1]
+		last.Speed += (dl.Speed - last.Speed) / float64(dl.sampleCount)
+		last.Percent = dl.Percent
+		return
+	}
+
+	dl.SpeedHistory = append(dl.SpeedHistory, SpeedSample{Time: now, Speed: dl.Speed, Percent: dl.Percent})
+	dl.sampleCount = 1
+	dl.historySent = false
+	if len(dl.SpeedHistory) <= maxSpeedSamples {
+		return
+	}
+
+	merged := make([]SpeedSample, 0, maxSpeedSamples)
+	for i := 0; i < len(dl.SpeedHistory); i += 2 {
+		s := dl.SpeedHistory[i]
+		if i+1 < len(dl.SpeedHistory) {
+			next := dl.SpeedHistory[i+1]
+			s.Speed = (s.Speed + next.Speed) / 2
+			s.Percent = next.Percent
+		}
+		merged = append(merged, s)
+	}
+	dl.SpeedHistory = merged
+	dl.sampleLength *= 2
+}
+
+// parseSize returns the number of bytes in a size printed by a downloader,
+// from the number and the unit, like "15.72" and "MiB".
+func parseSize(number, unit string) (int64, bool) {
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || unit == "" {
+		return 0, false
+	}
+	power := strings.Index("BKMGTPE", unit[:1])
+	if power < 0 {
+		return 0, false
+	}
+	base := 1000.0
+	if strings.Contains(unit, "i") {
+		base = 1024
+	}
+	return int64(n * math.Pow(base, float64(power))), true
+}
+
+// Throughput is the combined progress of all of the downloads which are
+// downloading.
+type Throughput struct {
+	Downloading     int     `json:"downloading"`      // how many downloads are downloading
+	Speed           float64 `json:"speed"`            // bytes per second, across all of them
+	DownloadedBytes int64   `json:"downloaded_bytes"` // so far, for those whose size is known
+	TotalBytes      int64   `json:"total_bytes"`      // for those whose size is known
+}
+
+// Throughput returns the combined progress of all of the downloads which are
+// downloading.
+func (m *Manager) Throughput() Throughput {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	t := Throughput{}
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if dl.State == STATE_DOWNLOADING {
+			t.Downloading++
+			t.Speed += dl.Speed
+			if dl.TotalBytes > 0 {
+				t.DownloadedBytes += dl.DownloadedBytes
+				t.TotalBytes += dl.TotalBytes
+			}
+		}
+		dl.Lock.Unlock()
+	}
+	return t
+}
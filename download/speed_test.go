@@ -0,0 +1,62 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestRecordSpeed(t *testing.T) {
+	dl := Download{}
+	start := time.Date(2024, 5, 13, 10, 0, 0, 0, time.UTC)
+
+	// readings within the length of a sample are averaged
+	for i, speed := range []float64{100, 200, 600} {
+		dl.Speed = speed
+		dl.Percent = float32(i)
+		dl.recordSpeed(start.Add(time.Duration(i) * time.Second))
+	}
+	assert.Equal(t, []SpeedSample{{Time: start, Speed: 300, Percent: 2}}, dl.SpeedHistory)
+
+	// the history never gets longer than the maximum, however long the download takes
+	for i := 1; i <= 3*maxSpeedSamples; i++ {
+		dl.Speed = float64(i)
+		dl.Percent = float32(i) / 2
+		dl.recordSpeed(start.Add(time.Duration(i) * speedSampleLength))
+	}
+	assert.LessOrEqual(t, len(dl.SpeedHistory), maxSpeedSamples)
+	assert.Greater(t, len(dl.SpeedHistory), maxSpeedSamples/2)
+	assert.Equal(t, start, dl.SpeedHistory[0].Time, "still covers the start")
+	assert.Equal(t, float32(3*maxSpeedSamples)/2, dl.SpeedHistory[len(dl.SpeedHistory)-1].Percent)
+	assert.Equal(t, 4*speedSampleLength, dl.sampleLength)
+
+	dl.resetProgress()
+	assert.Empty(t, dl.SpeedHistory)
+}
+
+func TestThroughput(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+
+	m := Manager{}
+	for _, d := range []struct {
+		state State
+		speed float64
+		total int64
+	}{
+		{STATE_DOWNLOADING, 1000, 4000},
+		{STATE_DOWNLOADING, 500, 0},
+		{STATE_PAUSED, 2000, 8000},
+	} {
+		dl := NewDownload("http://example.org/", cs.Config)
+		dl.State = d.state
+		dl.Speed = d.speed
+		dl.TotalBytes = d.total
+		dl.DownloadedBytes = d.total / 2
+		m.AddDownload(dl)
+	}
+
+	assert.Equal(t, Throughput{Downloading: 2, Speed: 1500, DownloadedBytes: 2000, TotalBytes: 4000}, m.Throughput())
+}
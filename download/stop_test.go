@@ -0,0 +1,71 @@
+//go:build !windows
+
+package download
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// running reports whether the process is still running. Killed processes
+// whose parent has gone may linger as zombies until they are reaped, which
+// do not count.
+func running(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		// no /proc on this platform
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestStopProcessGroup(t *testing.T) {
+	// the shell and its child ignore the gentler signals, so only the kill at
+	// the end stops them
+	m, dl := shutdownTestManager(t, `trap "" INT TERM; sleep 30 & echo $!; wait`)
+	dl.Config.Server.StopInterruptWait = "100ms"
+	dl.Config.Server.StopTerminateWait = "100ms"
+
+	// wait for the child to report its pid
+	var child int
+	assert.Eventually(t, func() bool {
+		dl.Lock.Lock()
+		defer dl.Lock.Unlock()
+		for _, l := range dl.Log {
+			if pid, err := strconv.Atoi(l); err == nil {
+				child = pid
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, dl.Stop())
+	assert.Error(t, dl.Stop(), "already stopping")
+
+	assert.Eventually(t, func() bool {
+		dl.Lock.Lock()
+		defer dl.Lock.Unlock()
+		return dl.State == STATE_STOPPED
+	}, 2*time.Second, 10*time.Millisecond)
+
+	dl.Lock.Lock()
+	assert.True(t, dl.Finished)
+	assert.Nil(t, dl.FailureReason, "stopped downloads have not failed")
+	dl.Lock.Unlock()
+	assert.Eventually(t, func() bool { return !running(child) }, time.Second, 10*time.Millisecond, "child process is killed too")
+	assert.Error(t, dl.Stop(), "already stopped")
+
+	assert.NoError(t, dl.Retry(), "stopped downloads can be retried")
+	m.Shutdown(time.Second)
+}
@@ -0,0 +1,277 @@
+package download
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tardisx/gropple/config"
+)
+
+// storeVersion is the version of the on-disk format written by the Store.
+const storeVersion = 1
+
+// Store persists the list of downloads to a JSON file on disk, so that the
+// queue and history survive a restart.
+type Store struct {
+	Path string
+	lock sync.Mutex
+	last []byte
+}
+
+// storedDownload is the on-disk representation of a Download.
+type storedDownload struct {
+	Id              int                    `json:"id"`
+	Url             string                 `json:"url"`
+	State           State                  `json:"state"`
+	DownloadProfile config.DownloadProfile `json:"download_profile"`
+	DownloadOption  *config.DownloadOption `json:"download_option"`
+	Finished        bool                   `json:"finished"`
+	ExitCode        int                    `json:"exit_code"`
+	Files           []string               `json:"files"`
+	OutputFiles     []OutputFile           `json:"output_files,omitempty"`
+	Log             []string               `json:"log"`
+	LogDropped      int                    `json:"log_dropped,omitempty"`
+	CreatedTS       time.Time              `json:"created_ts"`
+	StartedTS       time.Time              `json:"started_ts"`
+	FinishedTS      time.Time              `json:"finished_ts"`
+	ClonedFrom      int                    `json:"cloned_from,omitempty"`
+	Priority        int                    `json:"priority"`
+	Batch           int                    `json:"batch"`
+	StartAfter      *time.Time             `json:"start_after,omitempty"`
+	Attempt         int                    `json:"attempt"`
+	NotBefore       time.Time              `json:"not_before"`
+	FailureReason   *FailureReason         `json:"failure_reason,omitempty"`
+}
+
+// storeFile is the top level of the file written by the Store.
+type storeFile struct {
+	Version     int              `json:"version"`
+	QueuePaused bool             `json:"queue_paused"`
+	Downloads   []storedDownload `json:"downloads"`
+}
+
+// NewStore creates a Store which saves to the path given.
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+// Save writes the downloads, and the state of the queue, to disk. The file is
+// only rewritten if the contents have changed since the last save.
+func (s *Store) Save(sf storeFile) error {
+	sf.Version = storeVersion
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal downloads: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if bytes.Equal(b, s.last) {
+		return nil
+	}
+
+	// write to a temporary file first and rename it into place, so we never
+	// leave a half-written file behind
+	tmpPath := s.Path + ".tmp"
+	err = os.WriteFile(tmpPath, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write '%s': %w", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, s.Path)
+	if err != nil {
+		return fmt.Errorf("could not rename '%s' to '%s': %w", tmpPath, s.Path, err)
+	}
+	s.last = b
+	return nil
+}
+
+// Load reads the downloads, and the state of the queue, from disk. A missing
+// file is not an error, it just results in no downloads.
+func (s *Store) Load() (storeFile, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return storeFile{Downloads: []storedDownload{}}, nil
+	}
+	if err != nil {
+		return storeFile{}, fmt.Errorf("could not read '%s': %w", s.Path, err)
+	}
+
+	sf := storeFile{}
+	err = json.Unmarshal(b, &sf)
+	if err != nil {
+		return storeFile{}, fmt.Errorf("could not parse '%s': %w", s.Path, err)
+	}
+	if sf.Version > storeVersion {
+		return storeFile{}, fmt.Errorf("'%s' has version %d, we only understand up to %d", s.Path, sf.Version, storeVersion)
+	}
+	s.last = b
+
+	return sf, nil
+}
+
+// SetAside renames the file out of the way, so that a file which cannot be
+// loaded is kept for inspection rather than overwritten by the next save. It
+// returns the new path.
+func (s *Store) SetAside() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	badPath := s.Path + ".bad"
+	err := os.Rename(s.Path, badPath)
+	if err != nil {
+		return "", fmt.Errorf("could not rename '%s' to '%s': %w", s.Path, badPath, err)
+	}
+	s.last = nil
+	return badPath, nil
+}
+
+// StorePath returns the path to the download store, which lives in the same
+// directory as the configuration file.
+func StorePath(cs *config.ConfigService) string {
+	return filepath.Join(filepath.Dir(cs.ConfigPath), "downloads.json")
+}
+
+// stored returns the on-disk representation of this Download. Download must be locked.
+func (dl *Download) stored() storedDownload {
+	return storedDownload{
+		Id:              dl.Id,
+		Url:             dl.Url,
+		State:           dl.State,
+		DownloadProfile: dl.DownloadProfile,
+		DownloadOption:  dl.DownloadOption,
+		Finished:        dl.Finished,
+		ExitCode:        dl.ExitCode,
+		Files:           append([]string{}, dl.Files...),
+		OutputFiles:     dl.OutputFiles,
+		Log:             append([]string{}, dl.Log...),
+		LogDropped:      dl.LogDropped,
+		CreatedTS:       dl.CreatedTS,
+		StartedTS:       dl.StartedTS,
+		FinishedTS:      dl.FinishedTS,
+		ClonedFrom:      dl.ClonedFrom,
+		Priority:        dl.Priority,
+		Batch:           dl.Batch,
+		StartAfter:      dl.StartAfter,
+		Attempt:         dl.Attempt,
+		NotBefore:       dl.NotBefore,
+		FailureReason:   dl.FailureReason,
+	}
+}
+
+// downloadFromStored recreates a Download from its on-disk representation,
+// with its log file in logDir. Downloads which were queued or in progress are
+// queued again.
+func downloadFromStored(sd storedDownload, conf *config.Config, logDir string) *Download {
+	dl := &Download{
+		Id:              sd.Id,
+		Url:             sd.Url,
+		PopupUrl:        fmt.Sprintf("/fetch/%d", sd.Id),
+		State:           sd.State,
+		DownloadProfile: sd.DownloadProfile,
+		DownloadOption:  sd.DownloadOption,
+		Finished:        sd.Finished,
+		ExitCode:        sd.ExitCode,
+		Files:           sd.Files,
+		OutputFiles:     sd.OutputFiles,
+		Log:             sd.Log,
+		LogDropped:      sd.LogDropped,
+		CreatedTS:       sd.CreatedTS,
+		StartedTS:       sd.StartedTS,
+		FinishedTS:      sd.FinishedTS,
+		ClonedFrom:      sd.ClonedFrom,
+		Priority:        sd.Priority,
+		Batch:           sd.Batch,
+		StartAfter:      sd.StartAfter,
+		Attempt:         sd.Attempt,
+		NotBefore:       sd.NotBefore,
+		FailureReason:   sd.FailureReason,
+		Config:          conf,
+		logDir:          logDir,
+	}
+	if dl.Files == nil {
+		dl.Files = []string{}
+	}
+	if dl.Log == nil {
+		dl.Log = []string{}
+	}
+	if dl.Batch == 0 {
+		// saved before downloads had batches
+		dl.Batch = dl.Id
+	}
+
+	if !dl.Finished && dl.State != STATE_CHOOSE_PROFILE {
+		if dl.State != STATE_QUEUED {
+			dl.appendLog(fmt.Sprintf("interrupted while '%s' by a restart, queued again", dl.State))
+		}
+		dl.State = STATE_QUEUED
+	}
+	return dl
+}
+
+// Restore loads the downloads from the Store, and adds them to the Manager.
+// New downloads will be given ids following on from the restored ones.
+func (m *Manager) Restore(conf *config.Config) error {
+	if m.Store == nil {
+		return nil
+	}
+	sf, err := m.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.queuePaused = sf.QueuePaused
+	if m.queuePaused {
+		log.Print("the queue is paused, no downloads will be started until it is resumed")
+	}
+	for _, sd := range sf.Downloads {
+		dl := downloadFromStored(sd, conf, m.LogDir)
+		dl.feed = &m.changes
+		dl.bus = &m.Events
+		dl.wake = m.wakeup()
+		dl.clock = m.now
+		dl.sentLog = dl.LogDropped + len(dl.Log)
+		m.Downloads = append(m.Downloads, dl)
+
+		// make sure new downloads never reuse an id
+		for {
+			current := atomic.LoadInt32(&downloadId)
+			if int32(dl.Id) <= current || atomic.CompareAndSwapInt32(&downloadId, current, int32(dl.Id)) {
+				break
+			}
+		}
+	}
+	log.Printf("restored %d downloads from %s", len(sf.Downloads), m.Store.Path)
+	return nil
+}
+
+// persist saves the current list of downloads to the Store, if there is one.
+// Expects the Manager to be locked.
+func (m *Manager) persist() {
+	if m.Store == nil {
+		return
+	}
+	stored := make([]storedDownload, 0, len(m.Downloads))
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		stored = append(stored, dl.stored())
+		dl.Lock.Unlock()
+	}
+	err := m.Store.Save(storeFile{QueuePaused: m.queuePaused, Downloads: stored})
+	if err != nil {
+		log.Printf("could not save downloads: %s", err)
+	}
+}
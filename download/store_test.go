@@ -0,0 +1,97 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+
+	store := NewStore(filepath.Join(t.TempDir(), "downloads.json"))
+	m := Manager{Store: store}
+
+	queued := NewDownload("http://example.org/queued", conf)
+	queued.DownloadProfile = *conf.ProfileCalled("test profile")
+	queued.State = STATE_QUEUED
+
+	running := NewDownload("http://example.org/running", conf)
+	running.DownloadProfile = *conf.ProfileCalled("test profile")
+	running.State = STATE_DOWNLOADING
+	running.Files = []string{"partial.mp4"}
+	running.Log = []string{"some output"}
+	running.Batch = queued.Batch
+
+	complete := NewDownload("http://example.org/complete", conf)
+	complete.DownloadProfile = *conf.ProfileCalled("test profile")
+	complete.State = STATE_COMPLETE
+	complete.Finished = true
+	complete.Files = []string{"done.mp4"}
+
+	m.AddDownload(queued)
+	m.AddDownload(running)
+	m.AddDownload(complete)
+
+	m.Lock.Lock()
+	m.queuePaused = true
+	m.persist()
+	m.Lock.Unlock()
+
+	restored := Manager{Store: NewStore(store.Path)}
+	err := restored.Restore(conf)
+	if !assert.NoError(t, err) || !assert.Len(t, restored.Downloads, 3) {
+		t.FailNow()
+	}
+	assert.True(t, restored.QueuePaused(), "queue should still be paused")
+
+	assert.Equal(t, queued.Id, restored.Downloads[0].Id)
+	assert.Equal(t, STATE_QUEUED, restored.Downloads[0].State)
+
+	assert.Equal(t, STATE_QUEUED, restored.Downloads[1].State)
+	assert.Equal(t, []string{"partial.mp4"}, restored.Downloads[1].Files)
+	assert.Equal(t, "some output", restored.Downloads[1].Log[0])
+	assert.Equal(t, queued.Id, restored.Downloads[1].Batch)
+	assert.Len(t, restored.Downloads[1].Log, 2, "should note the interruption in the log")
+
+	assert.Equal(t, STATE_COMPLETE, restored.Downloads[2].State)
+	assert.True(t, restored.Downloads[2].Finished)
+	assert.Equal(t, "test profile", restored.Downloads[2].DownloadProfile.Name)
+
+	// new downloads must not reuse restored ids
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&downloadId), int32(complete.Id))
+	newer := NewDownload("http://example.org/newer", conf)
+	assert.Greater(t, newer.Id, complete.Id)
+}
+
+func TestStoreMissingFile(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "does-not-exist.json"))
+	sf, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, sf.Downloads)
+	assert.False(t, sf.QueuePaused)
+}
+
+func TestStoreSetAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "downloads.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "downloads": [`), 0644))
+
+	m := Manager{Store: NewStore(path)}
+	assert.Error(t, m.Restore(nil), "half-written file cannot be restored")
+
+	badPath, err := m.Store.SetAside()
+	assert.NoError(t, err)
+	assert.Equal(t, path+".bad", badPath)
+	assert.FileExists(t, badPath)
+	assert.NoFileExists(t, path)
+
+	// starts again with no downloads
+	assert.NoError(t, m.Restore(nil))
+	assert.Empty(t, m.Downloads)
+}
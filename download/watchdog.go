@@ -0,0 +1,67 @@
+package download
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// watchdog kills running downloads which have made no progress for longer than
+// the stall timeout in the config, or which have been running for longer than
+// the maximum runtime for their profile. Time spent paused counts towards
+// neither. It returns the next time at which a running download could need
+// killing, or the zero time if none could. Expects the Manager to be locked.
+func (m *Manager) watchdog() time.Time {
+	var stallTimeout time.Duration
+	if m.Config != nil {
+		stallTimeout = m.Config.Server.StallTimeoutDuration()
+	}
+
+	now := m.now()
+	var next time.Time
+	for _, dl := range m.Downloads {
+		dl.Lock.Lock()
+		if dl.Process != nil && dl.isActive() && dl.timedOut == nil && !dl.stopRequested {
+			next = soonest(next, dl.checkTimeouts(now, stallTimeout))
+		}
+		dl.Lock.Unlock()
+	}
+	return next
+}
+
+// checkTimeouts kills the download if it has stalled or run for too long.
+// Otherwise it returns the next time at which it could need killing, or the
+// zero time if it never will. Download must be locked.
+func (dl *Download) checkTimeouts(now time.Time, stallTimeout time.Duration) time.Time {
+	var next time.Time
+	if stallTimeout > 0 {
+		deadline := dl.LastActivity.Add(stallTimeout)
+		if !now.Before(deadline) {
+			dl.timeOut(FAILURE_STALLED, fmt.Sprintf("no progress for %s", stallTimeout))
+			return time.Time{}
+		}
+		next = deadline
+	}
+	if maxRuntime := dl.DownloadProfile.MaxRuntime(); maxRuntime > 0 {
+		deadline := dl.StartedTS.Add(maxRuntime + dl.pausedTotal)
+		if !now.Before(deadline) {
+			dl.timeOut(FAILURE_TIMED_OUT, fmt.Sprintf("still running after %s", maxRuntime))
+			return time.Time{}
+		}
+		next = soonest(next, deadline)
+	}
+	return next
+}
+
+// timeOut kills the download process, recording why. The download fails, or
+// is retried, once the process has exited. Download must be locked.
+func (dl *Download) timeOut(class FailureClass, message string) {
+	log.Printf("killing id: %d: %s", dl.Id, message)
+	dl.timedOut = &FailureReason{Class: class, Message: message}
+	dl.appendLog(fmt.Sprintf("---------- %s, killing the download ----------", message))
+	dl.publishChange()
+	err := killProcessGroup(dl.Process)
+	if err != nil {
+		log.Printf("could not kill process for id: %d: %s", dl.Id, err)
+	}
+}
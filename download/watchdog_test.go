@@ -0,0 +1,81 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+)
+
+func TestWatchdog(t *testing.T) {
+	cs := config.ConfigService{}
+	cs.LoadTestConfig()
+	conf := cs.Config
+	conf.Server.StallTimeout = "1m"
+
+	start := time.Now()
+	clock := start
+	m := &Manager{Config: conf, clock: func() time.Time { return clock }}
+	add := func(url string, profile config.DownloadProfile) *Download {
+		dl := NewDownload(url, conf)
+		dl.DownloadProfile = profile
+		m.AddDownload(dl)
+		m.Queue(dl)
+		return dl
+	}
+	stalled := add("http://a.example.org/", *conf.ProfileCalled("test profile"))
+	slow := add("http://b.example.org/", config.DownloadProfile{
+		Name: "slow", Command: "/bin/sleep", Args: []string{"5"}, MaximumRuntime: "2m",
+		Retry: config.RetryPolicy{MaxAttempts: 2, Backoff: []string{"1h"}, Retryable: []string{"timed-out"}},
+	})
+
+	m.Lock.Lock()
+	m.startQueued(0)
+	m.Lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	state := func(dl *Download, want State) func() bool {
+		return func() bool {
+			dl.Lock.Lock()
+			defer dl.Lock.Unlock()
+			return dl.State == want
+		}
+	}
+	// pretend the slow download keeps making progress
+	progress := func() {
+		slow.Lock.Lock()
+		slow.LastActivity = clock
+		slow.Lock.Unlock()
+	}
+
+	clock = start.Add(30 * time.Second)
+	m.Lock.Lock()
+	next := m.watchdog()
+	m.Lock.Unlock()
+	assert.WithinDuration(t, start.Add(time.Minute), next, time.Second, "next check is when they could stall")
+
+	clock = start.Add(90 * time.Second)
+	progress()
+	m.Lock.Lock()
+	m.watchdog()
+	m.Lock.Unlock()
+	assert.Eventually(t, state(stalled, STATE_TIMED_OUT), time.Second, 10*time.Millisecond)
+	stalled.Lock.Lock()
+	assert.Equal(t, FAILURE_STALLED, stalled.FailureReason.Class)
+	assert.Contains(t, stalled.Log[len(stalled.Log)-1], "no progress for 1m0s")
+	stalled.Lock.Unlock()
+	assert.True(t, state(slow, STATE_DOWNLOADING)(), "still making progress")
+
+	clock = start.Add(150 * time.Second)
+	progress()
+	m.Lock.Lock()
+	m.watchdog()
+	m.Lock.Unlock()
+	assert.Eventually(t, state(slow, STATE_QUEUED), time.Second, 10*time.Millisecond, "retried after running too long")
+	slow.Lock.Lock()
+	assert.Equal(t, FAILURE_TIMED_OUT, slow.FailureReason.Class)
+	slow.Lock.Unlock()
+
+	assert.NoError(t, stalled.Retry(), "timed out downloads can be retried")
+}
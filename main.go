@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/tardisx/gropple/config"
 	"github.com/tardisx/gropple/download"
 	v "github.com/tardisx/gropple/version"
 	"github.com/tardisx/gropple/web"
+	"github.com/tardisx/gropple/webhook"
 )
 
 var (
@@ -54,18 +61,49 @@ func main() {
 	}
 
 	// create the download manager
-	downloadManager := &download.Manager{MaxPerDomain: configService.Config.Server.MaximumActiveDownloads}
+	downloadManager := &download.Manager{
+		Config: configService.Config,
+		Store:  download.NewStore(download.StorePath(configService)),
+		LogDir: download.LogDirPath(configService),
+	}
+
+	// get ready to limit the resources downloads use, if any profiles do
+	download.PrepareLimits(configService.Config)
+
+	// bring back the downloads from before we were last stopped
+	err = downloadManager.Restore(configService.Config)
+	if err != nil {
+		log.Printf("could not restore downloads: %s", err)
+		// keep the file for inspection, rather than overwriting it on the next save
+		badPath, err := downloadManager.Store.SetAside()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("moved the download store to %s, starting with no downloads", badPath)
+	}
+
+	// send webhooks when things happen to downloads
+	webhookSender := webhook.NewSender(configService.Config)
+	go webhookSender.Run(&downloadManager.Events)
 
 	// create the web handlers
-	r := web.CreateRoutes(configService, downloadManager, versionInfo)
+	r := web.CreateRoutes(configService, downloadManager, versionInfo, webhookSender)
+
+	// cancelled when the server shuts down, so long-lived requests like the
+	// event stream finish
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 
 	srv := &http.Server{
 		Handler: r,
 		Addr:    fmt.Sprintf(":%d", configService.Config.Server.Port),
 		// Good practice: enforce timeouts for servers you create!
+		// Note that the event stream handler removes the write timeout for
+		// its own long-lived responses.
 		WriteTimeout: 5 * time.Second,
 		ReadTimeout:  5 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
+	srv.RegisterOnShutdown(cancelBase)
 
 	// check for a new version every 4 hours
 	go func() {
@@ -86,6 +124,41 @@ func main() {
 	downloadManager.AddStressTestData(configService)
 
 	log.Printf("Visit %s for details on installing the bookmarklet and to check status", configService.Config.Server.Address)
-	log.Fatal(srv.ListenAndServe())
 
+	// shut down cleanly on the first signal, and immediately on the second
+	shutdownDone := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Got %s, shutting down - send it again to exit immediately", sig)
+		go func() {
+			<-signals
+			log.Print("Exiting immediately")
+			downloadManager.Kill()
+			os.Exit(1)
+		}()
+		shutdown(srv, downloadManager, configService.Config.Server.ShutdownGrace())
+		close(shutdownDone)
+	}()
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Print("Shutdown complete")
+}
+
+// shutdown stops the web server, then gives running downloads the grace
+// period to exit before saving them to be queued again on the next start.
+func shutdown(srv *http.Server, dm *download.Manager, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("could not shut down web server cleanly: %s", err)
+	}
+
+	dm.Shutdown(grace)
 }
@@ -3,6 +3,7 @@ package web
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,11 +11,13 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tardisx/gropple/config"
 	"github.com/tardisx/gropple/download"
 	"github.com/tardisx/gropple/version"
+	"github.com/tardisx/gropple/webhook"
 )
 
 type successResponse struct {
@@ -27,6 +30,12 @@ type queuedResponse struct {
 	Location string `json:"location"`
 }
 
+type cleanupResponse struct {
+	Success bool     `json:"success"`
+	Message string   `json:"message"`
+	Files   []string `json:"files"`
+}
+
 type errorResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error"`
@@ -35,13 +44,19 @@ type errorResponse struct {
 //go:embed data/**
 var webFS embed.FS
 
-func CreateRoutes(cs *config.ConfigService, dm *download.Manager, vm *version.Manager) *mux.Router {
+func CreateRoutes(cs *config.ConfigService, dm *download.Manager, vm *version.Manager, ws *webhook.Sender) *mux.Router {
 	r := mux.NewRouter()
 
 	// main index page
 	r.HandleFunc("/", homeHandler(cs, vm, dm))
 	// update info on the status page
 	r.HandleFunc("/rest/fetch", fetchInfoRESTHandler(dm))
+	// stream changes to downloads as they happen
+	r.HandleFunc("/rest/events", eventsRESTHandler(dm))
+	// get/update the state of the queue
+	r.HandleFunc("/rest/queue", queueRESTHandler(dm))
+	// get the combined speed of all downloads
+	r.HandleFunc("/rest/throughput", throughputRESTHandler(dm)).Methods("GET")
 
 	// return static files
 	r.HandleFunc("/static/{filename}", staticHandler())
@@ -49,7 +64,9 @@ func CreateRoutes(cs *config.ConfigService, dm *download.Manager, vm *version.Ma
 	// return the config page
 	r.HandleFunc("/config", configHandler())
 	// handle config fetches/updates
-	r.HandleFunc("/rest/config", configRESTHandler(cs))
+	r.HandleFunc("/rest/config", configRESTHandler(cs, dm))
+	// send a test event to a webhook
+	r.HandleFunc("/rest/webhook/test", webhookTestRESTHandler(ws)).Methods("POST")
 
 	// create or present a download in the popup
 	r.HandleFunc("/fetch", fetchHandler(cs, vm, dm))
@@ -60,6 +77,8 @@ func CreateRoutes(cs *config.ConfigService, dm *download.Manager, vm *version.Ma
 
 	// get/update info on a download
 	r.HandleFunc("/rest/fetch/{id}", fetchInfoOneRESTHandler(cs, dm))
+	// download the full log of a download
+	r.HandleFunc("/rest/fetch/{id}/log", fetchLogRESTHandler(dm)).Methods("GET")
 
 	// version information
 	r.HandleFunc("/rest/version", versionRESTHandler(vm))
@@ -103,6 +122,7 @@ func homeHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Man
 			BookmarkletURL template.URL
 			Config         *config.Config
 			Version        version.Info
+			CanPause       bool
 		}
 
 		info := Info{
@@ -110,6 +130,7 @@ func homeHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Man
 			BookmarkletURL: template.URL(bookmarkletURL),
 			Config:         cs.Config,
 			Version:        vm.GetInfo(),
+			CanPause:       download.CanPauseDownload,
 		}
 
 		dm.Lock.Lock()
@@ -148,6 +169,38 @@ func staticHandler() func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// fetchLogRESTHandler returns the full log of a download as a text file
+func fetchLogRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		dl, err := dm.GetDlById(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		f, err := dl.FullLog()
+		if err != nil {
+			log.Printf("could not read log for id: %d: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gropple-%d.log"`, id))
+		w.WriteHeader(http.StatusOK)
+		_, err = io.Copy(w, f)
+		if err != nil {
+			log.Printf("could not write to client: %s", err)
+		}
+	}
+}
+
 // configHandler returns the configuration page
 func configHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -161,7 +214,9 @@ func configHandler() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = t.ExecuteTemplate(w, "layout", nil)
+		templateData := map[string]interface{}{"WebhookEvents": config.WebhookEvents, "FailureClasses": config.FailureClasses}
+
+		err = t.ExecuteTemplate(w, "layout", templateData)
 		if err != nil {
 			log.Printf("error: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -172,7 +227,7 @@ func configHandler() func(w http.ResponseWriter, r *http.Request) {
 }
 
 // configRESTHandler handles both reading and writing of the configuration
-func configRESTHandler(cs *config.ConfigService) func(w http.ResponseWriter, r *http.Request) {
+func configRESTHandler(cs *config.ConfigService, dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method == "POST" {
@@ -197,6 +252,8 @@ func configRESTHandler(cs *config.ConfigService) func(w http.ResponseWriter, r *
 				return
 			}
 			cs.WriteConfig()
+			// the schedule, domain rules or queue policy may have changed
+			dm.Wake()
 		}
 		b, _ := json.Marshal(cs.Config)
 		_, err := w.Write(b)
@@ -206,6 +263,28 @@ func configRESTHandler(cs *config.ConfigService) func(w http.ResponseWriter, r *
 	}
 }
 
+// webhookTestRESTHandler sends a test payload to the webhook in the request body,
+// which may not have been saved to the config yet.
+func webhookTestRESTHandler(ws *webhook.Sender) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook := config.Webhook{}
+		err := json.NewDecoder(r.Body).Decode(&hook)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		err = ws.SendTest(hook)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: fmt.Sprintf("could not send test event to '%s': %s", hook.URL, err)})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: fmt.Sprintf("test event sent to '%s'", hook.URL)})
+	}
+}
+
 func fetchInfoOneRESTHandler(cs *config.ConfigService, dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -229,7 +308,14 @@ func fetchInfoOneRESTHandler(cs *config.ConfigService, dm *download.Manager) fun
 			if r.Method == "POST" {
 
 				type updateRequest struct {
-					Action string `json:"action"`
+					Action               string     `json:"action"`
+					ProfileChosen        string     `json:"profile"`
+					DownloadOptionChosen *string    `json:"download_option"` // for the clone action, null for the same option or "" for none
+					Priority             int        `json:"priority"`        // for the priority action
+					To                   string     `json:"to"`              // for the move action, "top" or "bottom"
+					Before               int        `json:"before"`          // for the move action, the id to move before
+					StartAfter           *time.Time `json:"start_after"`     // for the schedule action, null to start as soon as possible
+					DryRun               bool       `json:"dry_run"`         // for the cleanup action, list the files without removing them
 				}
 
 				thisReq := updateRequest{}
@@ -256,13 +342,138 @@ func fetchInfoOneRESTHandler(cs *config.ConfigService, dm *download.Manager) fun
 
 				if thisReq.Action == "stop" {
 
-					thisDownload.Stop()
-					succRes := successResponse{Success: true, Message: "download stopped"}
-					succResB, _ := json.Marshal(succRes)
-					_, err = w.Write(succResB)
+					err = thisDownload.Stop()
 					if err != nil {
-						log.Printf("could not write to client: %s", err)
+						w.WriteHeader(http.StatusBadRequest)
+						_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+						return
+					}
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: "download stopping"})
+					return
+				}
+
+				if thisReq.Action == "pause" || thisReq.Action == "resume" {
+					var message string
+					if thisReq.Action == "pause" {
+						err = thisDownload.Pause()
+						message = "download paused"
+					} else {
+						err = thisDownload.Resume()
+						message = "download resumed"
+					}
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+						return
+					}
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: message})
+					return
+				}
+
+				if thisReq.Action == "retry" {
+					err = thisDownload.Retry()
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+						return
+					}
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: "download queued again"})
+					return
+				}
+
+				if thisReq.Action == "cleanup" {
+					var files []string
+					var message string
+					if thisReq.DryRun {
+						files, err = thisDownload.PartialFiles()
+						message = fmt.Sprintf("%d partial files found", len(files))
+					} else {
+						files, err = thisDownload.CleanUp()
+						message = fmt.Sprintf("%d partial files removed", len(files))
+					}
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+						return
+					}
+					_ = json.NewEncoder(w).Encode(cleanupResponse{Success: true, Message: message, Files: files})
+					return
+				}
+
+				if thisReq.Action == "priority" {
+					thisDownload.SetPriority(thisReq.Priority)
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: fmt.Sprintf("priority set to %d", thisReq.Priority)})
+					return
+				}
+
+				if thisReq.Action == "schedule" {
+					thisDownload.SetStartAfter(thisReq.StartAfter)
+					message := "download will start as soon as possible"
+					if thisReq.StartAfter != nil {
+						message = fmt.Sprintf("download will start after %s", thisReq.StartAfter.Local().Format(time.RFC1123))
+					}
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: message})
+					return
+				}
+
+				if thisReq.Action == "move" {
+					switch {
+					case thisReq.To == "top":
+						err = dm.MoveToTop(thisDownload)
+					case thisReq.To == "bottom":
+						err = dm.MoveToBottom(thisDownload)
+					case thisReq.Before > 0:
+						var before *download.Download
+						before, err = dm.GetDlById(thisReq.Before)
+						if err == nil {
+							err = dm.MoveBefore(thisDownload, before)
+						}
+					default:
+						err = errors.New("must move to the top, bottom or before another download")
+					}
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+						return
+					}
+					_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: "download moved"})
+					return
+				}
+
+				if thisReq.Action == "clone" {
+					// if no profile or option is chosen, use the ones from the original
+					thisDownload.Lock.Lock()
+					profile := thisDownload.DownloadProfile
+					option := thisDownload.DownloadOption
+					thisDownload.Lock.Unlock()
+
+					if thisReq.ProfileChosen != "" {
+						p := cs.Config.ProfileCalled(thisReq.ProfileChosen)
+						if p == nil {
+							w.WriteHeader(http.StatusBadRequest)
+							_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: fmt.Sprintf("no such profile: '%s'", thisReq.ProfileChosen)})
+							return
+						}
+						profile = *p
+					}
+
+					if thisReq.DownloadOptionChosen != nil && (option == nil || *thisReq.DownloadOptionChosen != option.Name) {
+						option = nil
+						if *thisReq.DownloadOptionChosen != "" {
+							option = cs.Config.DownloadOptionCalled(*thisReq.DownloadOptionChosen)
+							if option == nil {
+								w.WriteHeader(http.StatusBadRequest)
+								_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: fmt.Sprintf("no such download option: '%s'", *thisReq.DownloadOptionChosen)})
+								return
+							}
+						}
 					}
+
+					newDL := dm.Clone(thisDownload, profile, option)
+					_ = json.NewEncoder(w).Encode(queuedResponse{
+						Success:  true,
+						Location: fmt.Sprintf("/fetch/%d", newDL.Id),
+					})
 					return
 				}
 			}
@@ -287,6 +498,33 @@ func fetchInfoOneRESTHandler(cs *config.ConfigService, dm *download.Manager) fun
 func fetchInfoRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		if r.Method == "POST" {
+			type updateRequest struct {
+				Action string `json:"action"`
+			}
+
+			thisReq := updateRequest{}
+			err := json.NewDecoder(r.Body).Decode(&thisReq)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+				return
+			}
+
+			if thisReq.Action == "clear_finished" {
+				removed := dm.ClearFinished()
+				_ = json.NewEncoder(w).Encode(successResponse{
+					Success: true,
+					Message: fmt.Sprintf("removed %d finished downloads", removed),
+				})
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: fmt.Sprintf("unknown action '%s'", thisReq.Action)})
+			return
+		}
+
 		b, err := dm.DownloadsAsJSON()
 		if err != nil {
 			log.Printf("error: %s", err)
@@ -301,6 +539,158 @@ func fetchInfoRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *h
 	}
 }
 
+// queueRESTHandler returns whether the queue is paused, and allows it to be
+// paused or resumed
+func queueRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type queueStatus struct {
+			Paused bool `json:"paused"`
+		}
+
+		if r.Method == "POST" {
+			type updateRequest struct {
+				Action       string `json:"action"`
+				PauseRunning bool   `json:"pause_running"`
+			}
+
+			thisReq := updateRequest{}
+			err := json.NewDecoder(r.Body).Decode(&thisReq)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+				return
+			}
+
+			switch thisReq.Action {
+			case "pause":
+				err = dm.PauseQueue(thisReq.PauseRunning)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: err.Error()})
+					return
+				}
+				_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: "queue paused"})
+			case "resume":
+				dm.ResumeQueue()
+				_ = json.NewEncoder(w).Encode(successResponse{Success: true, Message: "queue resumed"})
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(errorResponse{Success: false, Error: fmt.Sprintf("unknown action '%s'", thisReq.Action)})
+			}
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(queueStatus{Paused: dm.QueuePaused()})
+	}
+}
+
+// throughputRESTHandler returns the combined progress of the downloads which are downloading
+func throughputRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(dm.Throughput())
+	}
+}
+
+// eventsRESTHandler streams changes to downloads to the client, using Server-Sent
+// Events. A "snapshot" event containing the full list of downloads is sent first,
+// followed by a "change" event for each update. If the optional "id" query parameter
+// is supplied, only that download is sent.
+func eventsRESTHandler(dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		onlyId := 0
+		if idString := r.URL.Query().Get("id"); idString != "" {
+			id, err := strconv.Atoi(idString)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			onlyId = id
+		}
+
+		// this is a long-lived response, so the server write timeout must not apply
+		rc := http.NewResponseController(w)
+		err := rc.SetWriteDeadline(time.Time{})
+		if err != nil {
+			log.Printf("could not clear write deadline for event stream: %s", err)
+		}
+
+		// subscribe before taking the snapshot, so nothing is missed in between
+		sub := dm.SubscribeChanges()
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		sendSnapshot := func() error {
+			var b []byte
+			var err error
+			if onlyId > 0 {
+				b, err = downloadAsJSONList(dm, onlyId)
+			} else {
+				b, err = dm.DownloadsAsJSON()
+			}
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", b)
+			if err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		err = sendSnapshot()
+		if err != nil {
+			log.Printf("could not write to client: %s", err)
+			return
+		}
+
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			case c := <-sub.C:
+				if sub.Lagged() {
+					// we missed some changes, start again from the current state
+					err = sendSnapshot()
+					break
+				}
+				if onlyId > 0 && c.Id != onlyId {
+					continue
+				}
+				b, _ := json.Marshal(c)
+				_, err = fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				log.Printf("could not write event to client: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// downloadAsJSONList returns a single download as a JSON list, or an empty
+// list if it does not exist.
+func downloadAsJSONList(dm *download.Manager, id int) ([]byte, error) {
+	dl, err := dm.GetDlById(id)
+	if err != nil {
+		return []byte("[]"), nil
+	}
+	dl.Lock.Lock()
+	defer dl.Lock.Unlock()
+	return json.Marshal([]*download.Download{dl})
+}
+
 // fetchHandler shows the popup, either the initial form (for create) or the form when in
 // progress (to be updated by REST). It also handles the form POST for creating a new download.
 func fetchHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Manager) func(w http.ResponseWriter, r *http.Request) {
@@ -334,7 +724,7 @@ func fetchHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Ma
 				return
 			}
 
-			templateData := map[string]interface{}{"dl": dl, "config": cs.Config, "canStop": download.CanStopDownload, "Version": vm.GetInfo()}
+			templateData := map[string]interface{}{"dl": dl, "config": cs.Config, "canStop": download.CanStopDownload, "canPause": download.CanPauseDownload, "Version": vm.GetInfo()}
 
 			err = t.ExecuteTemplate(w, "layout", templateData)
 			if err != nil {
@@ -347,9 +737,11 @@ func fetchHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Ma
 		} else if method == "POST" {
 			// creating a new one
 			type reqType struct {
-				URL                  string `json:"url"`
-				ProfileChosen        string `json:"profile"`
-				DownloadOptionChosen string `json:"download_option"`
+				URL                  string     `json:"url"`
+				ProfileChosen        string     `json:"profile"`
+				DownloadOptionChosen string     `json:"download_option"`
+				Priority             int        `json:"priority"`
+				StartAfter           *time.Time `json:"start_after"`
 			}
 
 			req := reqType{}
@@ -399,6 +791,8 @@ func fetchHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Ma
 				id := newDL.Id
 				newDL.DownloadOption = option
 				newDL.DownloadProfile = *profile
+				newDL.Priority = req.Priority
+				newDL.StartAfter = req.StartAfter
 				dm.AddDownload(newDL)
 				dm.Queue(newDL)
 
@@ -470,9 +864,11 @@ func bulkHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Man
 			return
 		case "POST":
 			type reqBulkType struct {
-				URLs                 string `json:"urls"`
-				ProfileChosen        string `json:"profile"`
-				DownloadOptionChosen string `json:"download_option"`
+				URLs                 string     `json:"urls"`
+				ProfileChosen        string     `json:"profile"`
+				DownloadOptionChosen string     `json:"download_option"`
+				Priority             int        `json:"priority"`
+				StartAfter           *time.Time `json:"start_after"`
 			}
 
 			req := reqBulkType{}
@@ -520,12 +916,19 @@ func bulkHandler(cs *config.ConfigService, vm *version.Manager, dm *download.Man
 			// create the new downloads
 			urls := strings.Split(req.URLs, "\n")
 			count := 0
+			batch := 0
 			for _, thisURL := range urls {
 				thisURL = strings.TrimSpace(thisURL)
 				if thisURL != "" {
 					newDL := download.NewDownload(thisURL, cs.Config)
 					newDL.DownloadOption = option
 					newDL.DownloadProfile = *profile
+					newDL.Priority = req.Priority
+					newDL.StartAfter = req.StartAfter
+					if batch == 0 {
+						batch = newDL.Id
+					}
+					newDL.Batch = batch
 					dm.AddDownload(newDL)
 					dm.Queue(newDL)
 					log.Printf("queued %s", thisURL)
@@ -0,0 +1,208 @@
+// Package webhook sends details of download events to user-configured URLs
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tardisx/gropple/config"
+	"github.com/tardisx/gropple/download"
+)
+
+// Payload is the JSON body sent to a webhook
+type Payload struct {
+	Event       string                `json:"event"`
+	Time        time.Time             `json:"time"`
+	Id          int                   `json:"id"`
+	Url         string                `json:"url"`
+	Profile     string                `json:"profile"`
+	Option      string                `json:"option,omitempty"`
+	State       download.State        `json:"state"`
+	ExitCode    int                   `json:"exit_code"`
+	Files       []string              `json:"files"`
+	OutputFiles []download.OutputFile `json:"output_files,omitempty"` // when the profile tracks files, checked when the download completed
+	Log         []string              `json:"log"`
+	File        string                `json:"file,omitempty"` // for file-added and file-removed events
+	Test        bool                  `json:"test,omitempty"` // set when sent from the config page
+}
+
+// Sender delivers webhooks for events from the download manager.
+type Sender struct {
+	Config  *config.Config
+	Client  *http.Client
+	Backoff []time.Duration // how long to wait before each retry
+}
+
+// NewSender creates a Sender for the webhooks in the config.
+func NewSender(conf *config.Config) *Sender {
+	return &Sender{
+		Config:  conf,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Backoff: []time.Duration{time.Second, 5 * time.Second, 30 * time.Second, 2 * time.Minute},
+	}
+}
+
+// PayloadFromEvent creates the webhook payload for a download event.
+func PayloadFromEvent(e download.Event) Payload {
+	p := Payload{
+		Event:       string(e.Type),
+		Time:        e.Time,
+		Id:          e.Download.Id,
+		Url:         e.Download.Url,
+		Profile:     e.Download.Profile,
+		Option:      e.Download.Option,
+		State:       e.Download.State,
+		ExitCode:    e.Download.ExitCode,
+		Files:       e.Download.Files,
+		OutputFiles: e.Download.OutputFiles,
+		Log:         e.Download.LogTail,
+		File:        e.File,
+	}
+	if p.Log == nil {
+		p.Log = []string{}
+	}
+	return p
+}
+
+// queueSize is how many payloads can be waiting to be delivered to each
+// webhook. Any more are dropped.
+const queueSize = 100
+
+// delivery is a payload waiting to be delivered to a webhook.
+type delivery struct {
+	hook    config.Webhook
+	payload Payload
+}
+
+// Run subscribes to the event bus and sends webhooks for each event, for
+// as long as the bus subscription is open. Each webhook has a queue of its
+// own, so one which is slow or failing does not hold up the others, and
+// events are always delivered to a webhook in the order they happened.
+func (s *Sender) Run(bus *download.EventBus) {
+	sub := bus.Subscribe(100)
+	defer sub.Close()
+
+	queues := make(map[string]chan delivery)
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+
+	for e := range sub.C {
+		for _, hook := range s.Config.Webhooks {
+			if !hook.WantsEvent(string(e.Type)) {
+				continue
+			}
+			q, ok := queues[hook.URL]
+			if !ok {
+				q = make(chan delivery, queueSize)
+				queues[hook.URL] = q
+				go s.deliverQueued(q)
+			}
+			select {
+			case q <- delivery{hook: hook, payload: PayloadFromEvent(e)}:
+			default:
+				log.Printf("too many webhooks waiting for %s, dropping %s event for id %d", hook.URL, e.Type, e.Download.Id)
+			}
+		}
+	}
+}
+
+// deliverQueued delivers each payload from the queue in turn, until it is
+// closed.
+func (s *Sender) deliverQueued(q <-chan delivery) {
+	for d := range q {
+		err := s.Deliver(d.hook, d.payload)
+		if err != nil {
+			log.Printf("giving up on webhook to %s for id %d: %s", d.hook.URL, d.payload.Id, err)
+		}
+	}
+}
+
+// Deliver sends the payload to the webhook, retrying with increasing delays if
+// it fails. It blocks until the webhook has been delivered, or all retries have
+// failed.
+func (s *Sender) Deliver(hook config.Webhook, p Payload) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		retryable, err = s.Send(hook, p)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= len(s.Backoff) {
+			return err
+		}
+		log.Printf("webhook to %s failed (%s), retrying in %s", hook.URL, err, s.Backoff[attempt])
+		time.Sleep(s.Backoff[attempt])
+	}
+}
+
+// Send makes a single attempt to send the payload to the webhook. If it fails,
+// it also reports whether the failure is worth retrying.
+func (s *Sender) Send(hook config.Webhook, p Payload) (bool, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return false, fmt.Errorf("could not marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(b))
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gropple")
+	req.Header.Set("X-Gropple-Event", p.Event)
+	for _, h := range hook.Headers {
+		req.Header.Set(h.Name, h.Value)
+	}
+	if hook.Secret != "" {
+		req.Header.Set("X-Gropple-Signature", "sha256="+Sign(hook.Secret, b))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("got status %s", resp.Status)
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, err
+}
+
+// SendTest sends an example payload to the webhook, without retrying.
+func (s *Sender) SendTest(hook config.Webhook) error {
+	p := Payload{
+		Event:    "completed",
+		Time:     time.Now(),
+		Url:      "https://example.org/video",
+		Profile:  "test profile",
+		State:    download.STATE_COMPLETE,
+		ExitCode: 0,
+		Files:    []string{"example video.mp4"},
+		Log:      []string{"this is a test event from gropple"},
+		Test:     true,
+	}
+	_, err := s.Send(hook, p)
+	return err
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body, using the secret as
+// the key.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
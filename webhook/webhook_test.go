@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tardisx/gropple/config"
+	"github.com/tardisx/gropple/download"
+)
+
+func testSender() *Sender {
+	s := NewSender(&config.Config{})
+	s.Backoff = []time.Duration{time.Millisecond, time.Millisecond}
+	return s
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var got Payload
+	var signature, auth, event string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Gropple-Signature")
+		auth = r.Header.Get("Authorization")
+		event = r.Header.Get("X-Gropple-Event")
+		assert.Equal(t, "sha256="+Sign("s3cret", b), signature)
+		_ = json.Unmarshal(b, &got)
+	}))
+	defer srv.Close()
+
+	hook := config.Webhook{
+		URL:     srv.URL,
+		Events:  []string{"completed"},
+		Headers: []config.WebhookHeader{{Name: "Authorization", Value: "Bearer abc"}},
+		Secret:  "s3cret",
+	}
+	e := download.Event{
+		Type: download.EVENT_COMPLETED,
+		Time: time.Now(),
+		Download: download.Snapshot{
+			Id: 12, Url: "https://example.org/v", Profile: "standard video",
+			State: download.STATE_COMPLETE, Files: []string{"v.mp4"}, LogTail: []string{"done"},
+		},
+	}
+
+	err := testSender().Deliver(hook, PayloadFromEvent(e))
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer abc", auth)
+	assert.Equal(t, "completed", event)
+	assert.Equal(t, 12, got.Id)
+	assert.Equal(t, "standard video", got.Profile)
+	assert.Equal(t, []string{"v.mp4"}, got.Files)
+	assert.Equal(t, []string{"done"}, got.Log)
+}
+
+func TestDeliverRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	hook := config.Webhook{URL: srv.URL, Events: []string{"failed"}}
+	err := testSender().Deliver(hook, Payload{Event: "failed"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// more failures than retries
+	calls.Store(-10)
+	err = testSender().Deliver(hook, Payload{Event: "failed"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(-7), calls.Load())
+}
+
+func TestDeliverNoRetryOnClientError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	err := testSender().Deliver(config.Webhook{URL: srv.URL}, Payload{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestRun(t *testing.T) {
+	received := make(chan Payload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := Payload{}
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		received <- p
+	}))
+	defer srv.Close()
+
+	s := testSender()
+	s.Config.Webhooks = []config.Webhook{{URL: srv.URL, Events: []string{"failed"}}}
+
+	bus := download.EventBus{}
+	go s.Run(&bus)
+	time.Sleep(50 * time.Millisecond) // let it subscribe
+
+	bus.Publish(download.Event{Type: download.EVENT_PROGRESS, Download: download.Snapshot{Id: 1}})
+	bus.Publish(download.Event{Type: download.EVENT_FAILED, Download: download.Snapshot{Id: 2}})
+
+	select {
+	case p := <-received:
+		assert.Equal(t, "failed", p.Event)
+		assert.Equal(t, 2, p.Id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not sent")
+	}
+	assert.Len(t, received, 0)
+}
+
+func TestRunInOrder(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first event needs a retry
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r.Header.Get("X-Gropple-Event")
+	}))
+	defer srv.Close()
+
+	s := testSender()
+	s.Backoff = []time.Duration{100 * time.Millisecond}
+	s.Config.Webhooks = []config.Webhook{{URL: srv.URL, Events: []string{"started", "completed"}}}
+
+	bus := download.EventBus{}
+	go s.Run(&bus)
+	time.Sleep(50 * time.Millisecond) // let it subscribe
+
+	bus.Publish(download.Event{Type: download.EVENT_STARTED, Download: download.Snapshot{Id: 1}})
+	bus.Publish(download.Event{Type: download.EVENT_COMPLETED, Download: download.Snapshot{Id: 1}})
+
+	for _, want := range []string{"started", "completed"} {
+		select {
+		case got := <-received:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s webhook was not sent", want)
+		}
+	}
+}